@@ -0,0 +1,202 @@
+/*
+Package admin - HTTP API для администрирования сервера. Ответы в формате JSON.
+
+	GET    /sessions                - сессии онлайн клиентов
+	DELETE /sessions/{id}           - закрыть сессию (id - номер сессии)
+	GET    /clients                 - зарегистрированные клиенты и количество не доставленных им сообщений
+	DELETE /clients/{client}        - удалить клиента (client - шестнадцатиричный идентификатор или имя)
+	PUT    /clients/{client}/secret - заменить секрет клиента, тело запроса base64(SHA256(name+password)) или проверочные ключи,
+	                                  все сессии клиента закрываются
+
+Каждый запрос должен содержать заголовок Authorization: Bearer AdminToken, без AdminToken API не запускается
+*/
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blabu/egeonC2cService/client/c2cService"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/data"
+	c2cData "github.com/blabu/egeonC2cService/data/c2cdata"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+const maxSecretSize = 1024 // Максимальный размер тела запроса на замену секрета
+
+// clientInfo - зарегистрированный клиент
+type clientInfo struct {
+	ID         string    `json:"ID"` // Идентификатор клиента в шестнадцатиричном виде
+	Name       string    `json:"Name"`
+	Registered time.Time `json:"Registered"`
+	LastSeen   time.Time `json:"LastSeen"`
+	LastAddr   string    `json:"LastAddr"`
+	Online     bool      `json:"Online"`
+	Pending    int       `json:"Pending"` // Количество не доставленных клиенту сообщений
+}
+
+type api struct {
+	db data.DB
+}
+
+// Start - запускает HTTP API на адресе addr, вернет сервер для его остановки
+func Start(addr string, db data.DB) (*http.Server, error) {
+	if len(cf.Get().AdminToken) == 0 {
+		return nil, errors.New("AdminToken is undefined")
+	}
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	a := &api{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.sessions)
+	mux.HandleFunc("/sessions/", a.session)
+	mux.HandleFunc("/clients", a.clients)
+	mux.HandleFunc("/clients/", a.client)
+	srv := &http.Server{Handler: authorized(mux)}
+	go func() {
+		if err := srv.Serve(listen); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin server finished with error %v", err)
+		}
+	}()
+	log.Info("Start admin server at ", addr)
+	return srv, nil
+}
+
+// authorized - пропускает только запросы с токеном AdminToken
+func authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := cf.Get().AdminToken
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			log.Warningf("Unauthorized admin request from %s", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(val); err != nil {
+		log.Warningf("Can not write admin answer %v", err)
+	}
+}
+
+// findID - идентификатор клиента по шестнадцатиричному идентификатору или имени, 0 если клиента нет
+func (a *api) findID(arg string) uint64 {
+	if id, err := strconv.ParseUint(arg, 16, 64); err == nil {
+		if _, err := a.db.GetClient(id); err == nil {
+			return id
+		}
+	}
+	id, _ := a.db.GetClientID(arg)
+	return id
+}
+
+// sessions - GET /sessions
+func (a *api) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c2cService.OnlineSessions())
+}
+
+// session - DELETE /sessions/{id}
+func (a *api) session(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 32)
+	if err != nil {
+		http.Error(w, "Incorrect session number", http.StatusBadRequest)
+		return
+	}
+	if !c2cService.KickSession(uint32(id)) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clients - GET /clients
+func (a *api) clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := make([]clientInfo, 0, 64)
+	a.db.ForEach(c2cData.Clients, func(key []byte, value []byte) error {
+		var cl dto.ClientDescriptor
+		if err := json.Unmarshal(value, &cl); err != nil {
+			log.Warningf("Incorrect client %x in database %v", key, err)
+			return nil
+		}
+		res = append(res, clientInfo{
+			ID:         strconv.FormatUint(cl.ID, 16),
+			Name:       cl.Name,
+			Registered: cl.RegisterDate,
+			LastSeen:   cl.LastSeen,
+			LastAddr:   cl.LastAddr,
+		})
+		return nil
+	})
+	for i := range res { // Вне транзакции перебора клиентов
+		id, _ := strconv.ParseUint(res[i].ID, 16, 64)
+		res[i].Online = c2cService.IsOnline(id)
+		res[i].Pending = a.db.Count(id)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	writeJSON(w, res)
+}
+
+// client - DELETE /clients/{client} и PUT /clients/{client}/secret
+func (a *api) client(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/clients/"), "/")
+	id := a.findID(path[0])
+	if id == 0 {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		c2cService.KickClient(id)
+		if err := a.db.DelClient(id); err != nil {
+			log.Error(err.Error())
+			http.Error(w, "Can not delete client", http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Client %x is deleted by administrator", id)
+	case len(path) == 2 && path[1] == "secret" && r.Method == http.MethodPut:
+		secret, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSecretSize))
+		if err != nil || len(secret) < 2 {
+			http.Error(w, "Incorrect secret", http.StatusBadRequest)
+			return
+		}
+		if err := a.db.SetSecret(id, strings.TrimSpace(string(secret))); err != nil {
+			log.Warning(err.Error())
+			http.Error(w, "Can not set secret", http.StatusBadRequest)
+			return
+		}
+		c2cService.KickClient(id)
+		log.Infof("Secret of client %x is replaced by administrator", id)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
+
+// Авторизация клиентов по схеме SCRAM-SHA-256.
+// Сервер не хранит ничего, что позволяет подписать запрос инициализации вместо клиента.
+// Паролем для схемы служит секрет клиента base64(SHA256(name+password)), который клиенты передавали раньше
+// SaltedPassword = PBKDF2-HMAC-SHA256(secret, salt, iterations)
+// ClientKey = HMAC(SaltedPassword, "Client Key"), StoredKey = SHA256(ClientKey)
+// ServerKey = HMAC(SaltedPassword, "Server Key")
+// ClientProof = ClientKey XOR HMAC(StoredKey, AuthMessage)
+// ServerSignature = HMAC(ServerKey, AuthMessage)
+
+// DefaultIterations - количество итераций PBKDF2 для новых клиентов
+const DefaultIterations = 4096
+
+const saltSize = 16
+
+// Secret - секрет клиента, который используется вместо пароля
+func Secret(name, password string) string {
+	s := sha256.Sum256([]byte(name + password))
+	return base64.StdEncoding.EncodeToString(s[:])
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// saltedPassword - PBKDF2 с одним блоком результата (размер равен размеру SHA256)
+func saltedPassword(secret string, salt []byte, iterations uint32) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	res := append([]byte(nil), u...)
+	for i := uint32(1); i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range res {
+			res[j] ^= u[j]
+		}
+	}
+	return res
+}
+
+func clientKey(secret string, salt []byte, iterations uint32) ([]byte, []byte) {
+	salted := saltedPassword(secret, salt, iterations)
+	return hmacSum(salted, "Client Key"), hmacSum(salted, "Server Key")
+}
+
+// SetVerifier - вычисляет и сохраняет в описании клиента проверочные ключи для секрета
+func SetVerifier(cl *dto.ClientDescriptor, secret string, iterations uint32) error {
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	ck, sk := clientKey(secret, salt, iterations)
+	stored := sha256.Sum256(ck)
+	cl.Salt = base64.StdEncoding.EncodeToString(salt)
+	cl.Iterations = iterations
+	cl.StoredKey = base64.StdEncoding.EncodeToString(stored[:])
+	cl.ServerKey = base64.StdEncoding.EncodeToString(sk)
+	cl.SecretKey = ""
+	return nil
+}
+
+// Verifier - проверочные ключи в виде salt;iterations;StoredKey;ServerKey (iterations в шестнадцатиричном виде).
+// Клиент может вычислить их сам и передать при регистрации вместо секрета
+func Verifier(secret string, iterations uint32) (string, error) {
+	var cl dto.ClientDescriptor
+	if err := SetVerifier(&cl, secret, iterations); err != nil {
+		return "", err
+	}
+	return strings.Join([]string{cl.Salt, strconv.FormatUint(uint64(cl.Iterations), 16), cl.StoredKey, cl.ServerKey}, ";"), nil
+}
+
+// ParseVerifier - сохраняет в описании клиента проверочные ключи полученные в виде salt;iterations;StoredKey;ServerKey
+func ParseVerifier(cl *dto.ClientDescriptor, verifier string) error {
+	fields := strings.Split(verifier, ";")
+	if len(fields) != 4 {
+		return errors.New("Verifier must contain salt;iterations;StoredKey;ServerKey")
+	}
+	iterations, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil || iterations == 0 {
+		return errors.New("Incorrect iterations count")
+	}
+	for _, f := range []string{fields[0], fields[2], fields[3]} {
+		if val, err := base64.StdEncoding.DecodeString(f); err != nil || len(val) == 0 {
+			return errors.New("Verifier fields must be base64 encoded")
+		}
+	}
+	cl.Salt = fields[0]
+	cl.Iterations = uint32(iterations)
+	cl.StoredKey = fields[2]
+	cl.ServerKey = fields[3]
+	cl.SecretKey = ""
+	return nil
+}
+
+// Challenge - параметры, которые клиент должен получить вместе с nonce: salt;iterations
+func Challenge(cl *dto.ClientDescriptor) string {
+	return cl.Salt + ";" + strconv.FormatUint(uint64(cl.Iterations), 16)
+}
+
+// ClientProof - подпись клиента для authMessage по параметрам из Challenge
+func ClientProof(secret, challenge, authMessage string) (proof string, serverSignature string, err error) {
+	fields := strings.Split(challenge, ";")
+	if len(fields) < 2 {
+		return "", "", errors.New("Challenge must contain salt;iterations")
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields[0])
+	if err != nil {
+		return "", "", err
+	}
+	iterations, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil {
+		return "", "", err
+	}
+	ck, sk := clientKey(secret, salt, uint32(iterations))
+	stored := sha256.Sum256(ck)
+	signature := hmacSum(stored[:], authMessage)
+	for i := range ck {
+		ck[i] ^= signature[i]
+	}
+	return base64.StdEncoding.EncodeToString(ck), base64.StdEncoding.EncodeToString(hmacSum(sk, authMessage)), nil
+}
+
+// Verify - проверяет подпись клиента, вернет подпись сервера для authMessage или ошибку
+func Verify(cl *dto.ClientDescriptor, authMessage, proof string) (string, error) {
+	stored, err := base64.StdEncoding.DecodeString(cl.StoredKey)
+	if err != nil || len(stored) != sha256.Size {
+		return "", errors.New("Client verifier is undefined")
+	}
+	ck, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(ck) != sha256.Size {
+		return "", errors.New("Incorrect proof format")
+	}
+	signature := hmacSum(stored, authMessage)
+	for i := range ck {
+		ck[i] ^= signature[i]
+	}
+	sum := sha256.Sum256(ck)
+	if subtle.ConstantTimeCompare(sum[:], stored) != 1 {
+		return "", errors.New("Incorrect proof")
+	}
+	sk, err := base64.StdEncoding.DecodeString(cl.ServerKey)
+	if err != nil {
+		return "", errors.New("Client verifier is undefined")
+	}
+	return base64.StdEncoding.EncodeToString(hmacSum(sk, authMessage)), nil
+}
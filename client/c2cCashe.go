@@ -8,24 +8,56 @@ import (
 	log "github.com/blabu/egeonC2cService/logWrapper"
 )
 
+// Соединение сессии клиента from с клиентом to.
+// Сообщения от сессии получают все сессии клиента to, а все сессии клиента to могут отвечать этой сессии
+type cachedLink struct {
+	from    uint64
+	session ListenerInterface // Сессия клиента from, создавшая соединение
+	to      uint64
+}
+
 // Структура клиента (для хранения его в онлайн кеше)
 type cachedClient struct {
-	base             ListenerInterface   // Указатель на сам клиент.
-	connectedReaders []ListenerInterface // Список указателей на всех клиентов, которые читают.
-	// Нужен для удаления данного клиента как публикующего данные у его читателей
-	mtx *sync.RWMutex // Для модификации connectedReaders
+	sessions []ListenerInterface // Все онлайн сессии клиента
+	links    []*cachedLink       // Соединения в которых участвует клиент.
+	// Нужны для удаления сессий клиента у его читателей и подключения к ним новых сессий
 }
 
 //ConnectionCache - кеш всех подключений
 type ConnectionCache struct {
-	onlineClientsCashe map[uint64]cachedClient
-	ml                 sync.RWMutex
+	onlineClientsCashe map[uint64]*cachedClient
+	ml                 sync.RWMutex // Берется раньше мьютексов клиентов (AddListener, DelListener)
 }
 
 // NewConnectionCache - Создает новый потокобезопасный кеш соединений
 func NewConnectionCache() ConnectionCache {
 	return ConnectionCache{
-		onlineClientsCashe: make(map[uint64]cachedClient),
+		onlineClientsCashe: make(map[uint64]*cachedClient),
+	}
+}
+
+func newCachedClient(cl ListenerInterface) *cachedClient {
+	return &cachedClient{
+		sessions: []ListenerInterface{cl},
+		links:    make([]*cachedLink, 0, configuration.Get().MaxPeerConnection), // Для избежания случайных переалокаций
+	}
+}
+
+func indexOfSession(list []ListenerInterface, cl ListenerInterface) int {
+	for i, val := range list {
+		if val == cl {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *cachedClient) delLink(l *cachedLink) {
+	for i, val := range c.links {
+		if val == l {
+			c.links = append(c.links[:i], c.links[i+1:]...)
+			return
+		}
 	}
 }
 
@@ -39,95 +71,253 @@ func (con *ConnectionCache) AddClientToCache(devID uint64, cl ListenerInterface)
 			log.Warning("Can not append new abonent with diviceID ", devID, " abonent exist")
 			return fmt.Errorf("Abonent exist")
 		}
-		allReaders := make([]ListenerInterface, 0, configuration.Config.MaxPeerConnection) // Для избежания случайных переалокаций
-		con.onlineClientsCashe[devID] = cachedClient{
-			base:             cl,
-			connectedReaders: allReaders,
-			mtx:              new(sync.RWMutex),
-		}
+		con.onlineClientsCashe[devID] = newCachedClient(cl)
 		return nil
 	}
 	return fmt.Errorf("Client is nil")
 }
 
-// DelClientFromCashe - delete this client from all connected to him valid devices
-// and than delete this client from online cache store
-func (con *ConnectionCache) DelClientFromCashe(devID uint64) {
+// AddSession - добавляет еще одну сессию клиента devID.
+// Новая сессия получает сообщения от всех, кто подключен к этому клиенту
+func (con *ConnectionCache) AddSession(devID uint64, cl ListenerInterface) error {
+	if cl == nil {
+		return fmt.Errorf("Client is nil")
+	}
 	con.ml.Lock()
 	defer con.ml.Unlock()
-	clientBase, ok := con.onlineClientsCashe[devID]
-	if ok { // If abonent exist
-		clientBase.mtx.RLock() // iterate by connectedReaders
-		for _, val := range clientBase.connectedReaders {
-			if val != nil {
-				val.DelListener(devID)
+	current, ok := con.onlineClientsCashe[devID]
+	if !ok {
+		con.onlineClientsCashe[devID] = newCachedClient(cl)
+		return nil
+	}
+	if indexOfSession(current.sessions, cl) >= 0 {
+		return nil
+	}
+	current.sessions = append(current.sessions, cl)
+	for _, l := range current.links {
+		if l.to == devID {
+			l.session.AddListener(devID, cl.GetQueue())
+			cl.AddListener(l.from, l.session.GetQueue())
+		}
+	}
+	return nil
+}
+
+// GetClient - вернет онлайн клиента по его идентификатору (первую его сессию)
+func (con *ConnectionCache) GetClient(devID uint64) (ListenerInterface, bool) {
+	con.ml.RLock()
+	defer con.ml.RUnlock()
+	cl, ok := con.onlineClientsCashe[devID]
+	if !ok || len(cl.sessions) == 0 {
+		return nil, false
+	}
+	return cl.sessions[0], true
+}
+
+// GetSessions - вернет все онлайн сессии клиента
+func (con *ConnectionCache) GetSessions(devID uint64) []ListenerInterface {
+	con.ml.RLock()
+	defer con.ml.RUnlock()
+	cl, ok := con.onlineClientsCashe[devID]
+	if !ok {
+		return nil
+	}
+	res := make([]ListenerInterface, len(cl.sessions))
+	copy(res, cl.sessions)
+	return res
+}
+
+// GetOnline - вернет копию списка всех онлайн клиентов с их сессиями
+func (con *ConnectionCache) GetOnline() map[uint64][]ListenerInterface {
+	con.ml.RLock()
+	defer con.ml.RUnlock()
+	res := make(map[uint64][]ListenerInterface, len(con.onlineClientsCashe))
+	for id, cl := range con.onlineClientsCashe {
+		res[id] = make([]ListenerInterface, len(cl.sessions))
+		copy(res[id], cl.sessions)
+	}
+	return res
+}
+
+// ReplaceClient - заменяет все сессии клиента devID на cl, подключенные к нему клиенты будут отправлять сообщения cl.
+// Вернет предыдущие сессии
+func (con *ConnectionCache) ReplaceClient(devID uint64, cl ListenerInterface) ([]ListenerInterface, error) {
+	if cl == nil {
+		return nil, fmt.Errorf("Client is nil")
+	}
+	con.ml.Lock()
+	defer con.ml.Unlock()
+	current, ok := con.onlineClientsCashe[devID]
+	if !ok || len(current.sessions) == 0 {
+		return nil, fmt.Errorf("Client with id %d not find in cache", devID)
+	}
+	old := current.sessions
+	con.replace(current, devID, old, cl)
+	current.sessions = []ListenerInterface{cl}
+	return old, nil
+}
+
+// ReplaceSession - заменяет сессию old клиента devID на cl, подключенные к ней клиенты будут отправлять сообщения cl
+func (con *ConnectionCache) ReplaceSession(devID uint64, old, cl ListenerInterface) error {
+	if cl == nil {
+		return fmt.Errorf("Client is nil")
+	}
+	con.ml.Lock()
+	defer con.ml.Unlock()
+	current, ok := con.onlineClientsCashe[devID]
+	if !ok {
+		return fmt.Errorf("Client with id %d not find in cache", devID)
+	}
+	i := indexOfSession(current.sessions, old)
+	if i < 0 {
+		return fmt.Errorf("Session of client %d not find in cache", devID)
+	}
+	con.replace(current, devID, []ListenerInterface{old}, cl)
+	current.sessions[i] = cl
+	return nil
+}
+
+// replace - заменяет очереди сессий old на очередь cl у всех подключенных клиентов. Вызывается под блокировкой ml
+func (con *ConnectionCache) replace(current *cachedClient, devID uint64, old []ListenerInterface, cl ListenerInterface) {
+	for _, l := range current.links {
+		receivers := []ListenerInterface{l.session} // Кому надо заменить очередь старых сессий
+		if l.from == devID {
+			if indexOfSession(old, l.session) < 0 {
+				continue
+			}
+			l.session = cl
+			peer, ok := con.onlineClientsCashe[l.to]
+			if !ok {
+				continue
+			}
+			receivers = peer.sessions
+		}
+		for _, r := range receivers {
+			for _, o := range old {
+				r.DelListener(devID, o.GetQueue())
+			}
+			r.AddListener(devID, cl.GetQueue())
+		}
+	}
+}
+
+// detach - удаляет очередь сессии cl клиента devID у всех подключенных к ней клиентов.
+// Соединения, созданные этой сессией, удаляются. Вызывается под блокировкой ml
+func (con *ConnectionCache) detach(current *cachedClient, devID uint64, cl ListenerInterface) {
+	links := make([]*cachedLink, 0, len(current.links))
+	for _, l := range current.links {
+		if l.from == devID && l.session == cl {
+			if peer, ok := con.onlineClientsCashe[l.to]; ok {
+				for _, s := range peer.sessions {
+					s.DelListener(devID, cl.GetQueue())
+				}
+				peer.delLink(l)
 			}
+			continue
 		}
-		clientBase.mtx.RUnlock()
-		delete(con.onlineClientsCashe, devID)
-	} else {
+		if l.to == devID {
+			l.session.DelListener(devID, cl.GetQueue())
+		}
+		links = append(links, l)
+	}
+	current.links = links
+}
+
+// DelClientFromCashe - delete this session of client from all connected to him valid devices
+// and than delete it from online cache store. Return count of remaining sessions of the client
+func (con *ConnectionCache) DelClientFromCashe(devID uint64, cl ListenerInterface) int {
+	con.ml.Lock()
+	defer con.ml.Unlock()
+	current, ok := con.onlineClientsCashe[devID]
+	if !ok { // If abonent does not exist
 		log.Errorf("Client with id %d not find in cache for delete it", devID)
+		return 0
 	}
+	i := indexOfSession(current.sessions, cl)
+	if i < 0 {
+		log.Errorf("Session of client %d not find in cache for delete it", devID)
+		return len(current.sessions)
+	}
+	con.detach(current, devID, cl)
+	current.sessions = append(current.sessions[:i], current.sessions[i+1:]...)
+	if len(current.sessions) != 0 {
+		return len(current.sessions)
+	}
+	for _, l := range current.links { // Остались только соединения с этим клиентом созданные другими
+		if peer, ok := con.onlineClientsCashe[l.from]; ok {
+			peer.delLink(l)
+		}
+	}
+	delete(con.onlineClientsCashe, devID)
+	return 0
 }
 
-// DisconnectClient - close connection from devTo and devFrom
-func (con *ConnectionCache) DisconnectClient(devTo, devFrom uint64) error {
-	con.ml.RLock()
-	cTo, ok1 := con.onlineClientsCashe[devTo]
-	cFrom, ok2 := con.onlineClientsCashe[devFrom]
-	con.ml.RUnlock()
-	if !ok1 || !ok2 || cTo.base == nil || cFrom.base == nil {
+// DisconnectAll - удаляет все соединения сессии cl клиента devID, сама сессия остается в кеше
+func (con *ConnectionCache) DisconnectAll(devID uint64, cl ListenerInterface) {
+	con.ml.Lock()
+	defer con.ml.Unlock()
+	if current, ok := con.onlineClientsCashe[devID]; ok {
+		con.detach(current, devID, cl)
+	}
+}
+
+// DisconnectClient - close connection between session cl of client devFrom and client devTo
+func (con *ConnectionCache) DisconnectClient(devFrom uint64, cl ListenerInterface, devTo uint64) error {
+	con.ml.Lock()
+	defer con.ml.Unlock()
+	cFrom, ok1 := con.onlineClientsCashe[devFrom]
+	cTo, ok2 := con.onlineClientsCashe[devTo]
+	if !ok1 || !ok2 {
 		err := fmt.Errorf("Some of clients is undefined %d, %d", devTo, devFrom)
 		log.Warning(err.Error())
 		return err
 	}
-	if cFrom.connectedReaders == nil || cTo.connectedReaders == nil {
-		err := fmt.Errorf("Some of clients is invalid %d, %d", devTo, devFrom)
-		log.Warning(err.Error())
-		return err
+	cl.DelListener(devTo, nil)
+	links := make([]*cachedLink, 0, len(cFrom.links))
+	for _, l := range cFrom.links {
+		if l.from == devFrom && l.session == cl && l.to == devTo { // Соединение этой сессии удаляется полностью
+			for _, s := range cTo.sessions {
+				s.DelListener(devFrom, cl.GetQueue())
+			}
+			cTo.delLink(l)
+			continue
+		}
+		if l.from == devTo && l.to == devFrom { // Отключаем только эту сессию
+			l.session.DelListener(devFrom, cl.GetQueue())
+		}
+		links = append(links, l)
 	}
-	cFrom.base.DelListener(devTo)
-	cTo.base.DelListener(devFrom)
+	cFrom.links = links
 	return nil
 }
 
-// ConnectClients - Создает соединение и регистрирует его в кеше
-func (con *ConnectionCache) ConnectClients(devTo, devFrom uint64) error {
-	con.ml.RLock()
+// ConnectClients - Создает соединение сессии from клиента devFrom со всеми сессиями клиента devTo и регистрирует его в кеше
+func (con *ConnectionCache) ConnectClients(devTo, devFrom uint64, from ListenerInterface) error {
+	con.ml.Lock()
+	defer con.ml.Unlock()
 	cTo, ok1 := con.onlineClientsCashe[devTo]
 	cFrom, ok2 := con.onlineClientsCashe[devFrom]
-	con.ml.RUnlock()
-	if !ok1 || cTo.base == nil || cFrom.connectedReaders == nil {
-		if !ok1 {
-			log.Warningf("Client %d not find in online cache", devTo)
-		} else if cTo.base == nil {
-			log.Errorf("Client %d in online cache is nil", devTo)
-		} else if cFrom.connectedReaders == nil {
-			log.Errorf("Client %d in online cache is not correct", devFrom)
-		}
+	if !ok1 || len(cTo.sessions) == 0 {
+		log.Warningf("Client %d not find in online cache", devTo)
 		return fmt.Errorf("Can not create connection to device %d", devTo)
 	}
-	if !ok2 || cFrom.base == nil || cTo.connectedReaders == nil {
-		if !ok2 {
-			log.Warningf("Client %d not find in online cache", devFrom)
-		} else if cFrom.base == nil {
-			log.Errorf("Client %d in online cache is nil", devFrom)
-		} else if cFrom.connectedReaders == nil {
-			log.Errorf("Client from %d in online cache is not correct", devFrom)
+	if !ok2 || from == nil || indexOfSession(cFrom.sessions, from) < 0 {
+		log.Warningf("Client %d not find in online cache", devFrom)
+		return fmt.Errorf("Can not create connection from device %d", devFrom)
+	}
+	for _, s := range cTo.sessions {
+		from.AddListener(devTo, s.GetQueue())
+		s.AddListener(devFrom, from.GetQueue())
+	}
+	for _, l := range cFrom.links {
+		if l.from == devFrom && l.session == from && l.to == devTo {
+			return nil // Такое соединение уже есть
 		}
-		return fmt.Errorf("Can not create connection from device %d", devTo)
-	}
-	cFrom.base.AddListener(devTo, cTo.base.GetListenerChan())
-	cTo.base.AddListener(devFrom, cFrom.base.GetListenerChan())
-	cTo.mtx.Lock()
-	cTo.connectedReaders = append(cTo.connectedReaders, cFrom.base)
-	cTo.mtx.Unlock()
-	cFrom.mtx.Lock()
-	cFrom.connectedReaders = append(cFrom.connectedReaders, cTo.base)
-	cFrom.mtx.Unlock()
-	con.ml.Lock()
-	con.onlineClientsCashe[devTo] = cTo
-	con.onlineClientsCashe[devFrom] = cFrom
-	con.ml.Unlock()
+	}
+	l := &cachedLink{from: devFrom, session: from, to: devTo}
+	cFrom.links = append(cFrom.links, l)
+	if devTo != devFrom {
+		cTo.links = append(cTo.links, l)
+	}
 	return nil
 }
@@ -0,0 +1,113 @@
+package c2cService
+
+import (
+	"strconv"
+	"strings"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/data"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Правила доступа определяют кто может подключиться к клиенту командами ConnectByID и ConnectByName:
+// id:<hex> - клиент с указанным идентификатором
+// type:<hex> - все клиенты указанного типа
+// * - все клиенты
+// ? - остальные клиенты могут подключиться только после подтверждения (см. approve.go)
+// Если правила для клиента не заданы, подключение разрешено, если в конфигурации не указан DenyConnectDefault
+
+// parseAccessRule - проверяет правило и приводит его к единому виду
+func parseAccessRule(rule string) (string, bool) {
+	if rule == "*" || rule == "?" {
+		return rule, true
+	}
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 || (parts[0] != "id" && parts[0] != "type") {
+		return "", false
+	}
+	val, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil || (parts[0] == "type" && val > 0xFFFF) {
+		return "", false
+	}
+	return parts[0] + ":" + strconv.FormatUint(val, 16), true
+}
+
+// isAllowed - может ли клиент from подключиться к клиенту target
+func isAllowed(db data.DB, target, from uint64) bool {
+	rules, err := db.GetAccess(target)
+	if err != nil {
+		return !cf.Get().DenyConnectDefault
+	}
+	id := "id:" + strconv.FormatUint(from, 16)
+	fromType, _ := data.SplitClientID(from)
+	clType := "type:" + strconv.FormatUint(uint64(fromType), 16)
+	for _, r := range rules {
+		if r == "*" || r == id || r == clType {
+			return true
+		}
+	}
+	return false
+}
+
+// needApproval - клиент target сам подтверждает соединения, не разрешенные правилами
+func needApproval(db data.DB, target uint64) bool {
+	rules, err := db.GetAccess(target)
+	return err == nil && indexOf(rules, "?") >= 0
+}
+
+// access - управление правилами доступа к своему клиенту.
+// Content: пусто - получить список правил, +правило - добавить, -правило - удалить. Изменения разделяются ;
+// В ответ приходит итоговый список правил через ;
+func (c *C2cDevice) access(m *dto.Message) error {
+	if c.device.ID == 0 {
+		return NewC2cError(BadCommandError, "Initialize device at first")
+	}
+	rules, _ := c.storage.GetAccess(c.device.ID)
+	if len(m.Content) != 0 {
+		for _, op := range strings.Split(string(m.Content), ";") {
+			if len(op) < 2 {
+				return Errorf(BadCommandError, "Incorrect access operation %s in session %d", op, c.sessionID)
+			}
+			rule, ok := parseAccessRule(op[1:])
+			if !ok {
+				return Errorf(BadCommandError, "Incorrect access rule %s in session %d", op[1:], c.sessionID)
+			}
+			switch op[0] {
+			case '+':
+				if indexOf(rules, rule) < 0 {
+					rules = append(rules, rule)
+				}
+			case '-':
+				if i := indexOf(rules, rule); i >= 0 {
+					rules = append(rules[:i], rules[i+1:]...)
+				}
+			default:
+				return Errorf(BadCommandError, "Undefined access operation %c in session %d", op[0], c.sessionID)
+			}
+		}
+		if err := c.storage.SetAccess(c.device.ID, rules); err != nil {
+			log.Error(err.Error())
+			return Errorf(InternalError, "Can not save access rules for client %x", c.device.ID)
+		}
+		log.Infof("Access rules for client %x changed to %v", c.device.ID, rules)
+	}
+	c.queue.Put(dto.Message{
+		Command: dto.AccessCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.From,
+		Content: []byte(strings.Join(rules, ";")),
+	})
+	return nil
+}
+
+func indexOf(list []string, val string) int {
+	for i, v := range list {
+		if v == val {
+			return i
+		}
+	}
+	return -1
+}
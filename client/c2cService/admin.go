@@ -0,0 +1,113 @@
+package c2cService
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Функции для администрирования сервера (см. пакет admin)
+
+const kickTimeOut = 5 * time.Second // Время ожидания закрытия сессий отключаемого клиента
+
+// SessionInfo - описание сессии онлайн клиента
+type SessionInfo struct {
+	SessionID  uint32   `json:"SessionID"`
+	ClientID   string   `json:"ClientID"` // Идентификатор клиента в шестнадцатиричном виде
+	Name       string   `json:"Name"`
+	RemoteAddr string   `json:"RemoteAddr"`
+	Peers      []string `json:"Peers"` // Идентификаторы клиентов, подключенных к этому клиенту, клиенты соседних серверов в виде ID@сосед
+}
+
+// info - описание сессии клиента id
+func (c *C2cDevice) info(id uint64) SessionInfo {
+	c.listenerMtx.RLock()
+	peers := make([]string, 0, len(c.listenerList)+len(c.remoteList))
+	for from := range c.listenerList {
+		peers = append(peers, strconv.FormatUint(from, 16))
+	}
+	for r := range c.remoteList {
+		peers = append(peers, r.String())
+	}
+	c.listenerMtx.RUnlock()
+	sort.Strings(peers)
+	_, name, _ := c.identity()
+	return SessionInfo{
+		SessionID:  c.sessionID,
+		ClientID:   strconv.FormatUint(id, 16),
+		Name:       name,
+		RemoteAddr: c.remoteAddr,
+		Peers:      peers,
+	}
+}
+
+// OnlineSessions - сессии всех онлайн клиентов, в том числе ожидающие продолжения
+func OnlineSessions() []SessionInfo {
+	online := connection.GetOnline()
+	res := make([]SessionInfo, 0, len(online))
+	for id, sessions := range online {
+		for _, s := range sessions {
+			if c, ok := s.(*C2cDevice); ok {
+				res = append(res, c.info(id))
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].SessionID < res[j].SessionID })
+	return res
+}
+
+// IsOnline - true если у клиента id есть хотя бы одна сессия
+func IsOnline(id uint64) bool {
+	_, ok := connection.GetClient(id)
+	return ok
+}
+
+// KickSession - закрывает сессию sessionID, вернет false если такой сессии нет
+func KickSession(sessionID uint32) bool {
+	if p := resumes.takeSession(sessionID); p != nil {
+		p.release()
+		log.Infof("Waiting session %d of client %s is closed by administrator", sessionID, p.dev.device.Name)
+		p.dev.shutdown()
+		return true
+	}
+	for _, c := range devices.all() {
+		if c.sessionID == sessionID {
+			_, name, _ := c.identity()
+			log.Infof("Session %d of client %s is closed by administrator", sessionID, name)
+			c.queue.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// KickClient - закрывает все сессии клиента id и ждет их завершения, вернет количество закрытых сессий
+func KickClient(id uint64) int {
+	parked := resumes.takeClient(id)
+	for _, p := range parked {
+		p.release()
+		p.dev.shutdown()
+	}
+	sessions := connection.GetSessions(id)
+	for _, s := range sessions {
+		s.GetQueue().Close()
+	}
+	cnt := len(parked) + len(sessions)
+	if cnt != 0 {
+		log.Infof("%d sessions of client %x are closed by administrator", cnt, id)
+	}
+	deadline := time.After(kickTimeOut)
+	for _, s := range sessions {
+		if c, ok := s.(*C2cDevice); ok {
+			select {
+			case <-c.done:
+			case <-deadline:
+				log.Warningf("Session %d of client %x is not closed in %v", c.sessionID, id, kickTimeOut)
+				return cnt
+			}
+		}
+	}
+	return cnt
+}
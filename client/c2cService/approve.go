@@ -0,0 +1,165 @@
+package c2cService
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blabu/egeonC2cService/client"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Подтверждение соединения клиентом.
+// Если в правилах доступа клиента есть правило ?, запросы на соединение от клиентов, которым соединение не разрешено
+// другими правилами, передаются ему командой ApproveCOMMAND (From - идентификатор запрашивающего, Content - его имя).
+// Клиент отвечает той же командой с To - идентификатор запрашивающего и Content ACCEPT или REJECT.
+// Запрашивающий получает обычный ответ на запрос соединения, ошибку AccessDeniedError или ReadTimeoutError,
+// если ответа не было в течении ApproveTimeOut секунд
+
+const approveAccept = "ACCEPT"
+const approveReject = "REJECT"
+
+type approvalKey struct {
+	target uint64
+	from   uint64
+}
+
+// approval - запрос соединения, ожидающий решения клиента
+type approval struct {
+	command uint16
+	from    string // Отправитель так как он был указан в запросе
+	to      string // Адресат так как он был указан в запросе
+	proto   uint16
+	jmp     uint16
+	session *C2cDevice // Сессия, запросившая соединение
+	timer   *time.Timer
+}
+
+type approvalList struct {
+	list map[approvalKey]*approval
+	mtx  sync.Mutex
+}
+
+var approvals = approvalList{list: make(map[approvalKey]*approval)}
+
+func approveTimeOut() time.Duration {
+	if cf.Get().ApproveTimeOut == 0 {
+		return cf.DefaultApproveTimeOut * time.Second
+	}
+	return time.Duration(cf.Get().ApproveTimeOut) * time.Second
+}
+
+// add - сохраняет запрос и запускает его таймер, по истечении ApproveTimeOut вызывается timeout.
+// Предыдущий запрос того же клиента к тому же адресату отменяется
+func (a *approvalList) add(key approvalKey, val *approval, timeout func()) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if old, ok := a.list[key]; ok {
+		old.timer.Stop()
+	}
+	val.timer = time.AfterFunc(approveTimeOut(), timeout)
+	a.list[key] = val
+}
+
+// take - удаляет и возвращает запрос, вернет nil если его уже нет
+func (a *approvalList) take(key approvalKey, val *approval) *approval {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	res, ok := a.list[key]
+	if !ok || (val != nil && res != val) {
+		return nil
+	}
+	delete(a.list, key)
+	return res
+}
+
+// answer - передает ответ запросившей соединение сессии, если она еще на связи
+func (p *approval) answer(m dto.Message) {
+	p.session.GetQueue().Put(m)
+}
+
+// answerError - ответ с ошибкой запросившей соединение сессии
+func (p *approval) answerError(code uint16, text string) {
+	req := dto.Message{From: p.from, Proto: p.proto, Jmp: p.jmp}
+	p.answer(client.ErrorMessage(&req, code, text))
+}
+
+// askApproval - передает запрос соединения на подтверждение клиенту target
+func (c *C2cDevice) askApproval(m *dto.Message, target uint64) error {
+	sessions := connection.GetSessions(target)
+	if len(sessions) == 0 {
+		return Errorf(ClientNotFindError, "Client %s is offline and can not approve connection", m.To)
+	}
+	key := approvalKey{target: target, from: c.device.ID}
+	p := &approval{
+		command: m.Command,
+		from:    m.From,
+		to:      m.To,
+		proto:   m.Proto,
+		jmp:     m.Jmp,
+		session: c,
+	}
+	approvals.add(key, p, func() {
+		if approvals.take(key, p) != nil {
+			p.answerError(ReadTimeoutError, "Client "+p.to+" did not approve connection")
+		}
+	})
+	request := dto.Message{
+		Command: dto.ApproveCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    strconv.FormatUint(c.device.ID, 16),
+		To:      m.To,
+		Content: []byte(c.device.Name),
+	}
+	for _, cl := range sessions { // Решение может принять любая сессия клиента
+		cl.GetQueue().Put(request)
+	}
+	log.Infof("Connection from %s to %s is waiting for approval", m.From, m.To)
+	return nil
+}
+
+// approve - решение клиента по запросу соединения. m.To - идентификатор запросившего клиента, Content - ACCEPT или REJECT
+func (c *C2cDevice) approve(m *dto.Message) error {
+	if c.device.ID == 0 {
+		return NewC2cError(BadCommandError, "Initialize device at first")
+	}
+	from, err := strconv.ParseUint(m.To, 16, 64)
+	if err != nil {
+		return Errorf(BadCommandError, "\"%s\" must be a number", m.To)
+	}
+	decision := string(m.Content)
+	if decision != approveAccept && decision != approveReject {
+		return Errorf(BadCommandError, "Undefined decision %s in session %d", decision, c.sessionID)
+	}
+	p := approvals.take(approvalKey{target: c.device.ID, from: from}, nil)
+	if p == nil {
+		return Errorf(ClientNotFindError, "Connection request from %s not found", m.To)
+	}
+	p.timer.Stop()
+	if decision == approveReject {
+		p.answerError(AccessDeniedError, "Client "+p.to+" rejected connection")
+		log.Infof("Client %x rejected connection from %x", c.device.ID, from)
+		return nil
+	}
+	if err := connection.ConnectClients(c.device.ID, from, p.session); err != nil {
+		log.Warning(err.Error())
+		return Errorf(ClientNotFindError, "Can not create connection from %x with abonnent %x", from, c.device.ID)
+	}
+	answer := answerConnectByIDOk
+	if p.command == dto.ConnectByNameCOMMAND {
+		answer = answerConnectByNameOk
+	}
+	p.answer(dto.Message{
+		Command: p.command,
+		Jmp:     p.jmp,
+		Proto:   p.proto,
+		From:    p.to,
+		To:      p.from,
+		Content: []byte(answer),
+	})
+	log.Infof("Client %x accepted connection from %x", c.device.ID, from)
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/blabu/egeonC2cService/data"
 	"github.com/blabu/egeonC2cService/dto"
@@ -26,7 +27,7 @@ type C2cError struct {
 	text    string
 }
 
-// Возможные типы ошибок клиентской логики
+// Возможные типы ошибок клиентской логики. Коды передаются клиентам, поэтому новые коды добавляются только в конец
 const (
 	ClientNotFindError uint16 = iota + 1
 	ReadTimeoutError
@@ -39,6 +40,8 @@ const (
 	InvalidCredentials
 	BadMessageError
 	NilMessageError
+	/*=================================================================================================================*/
+	AccessDeniedError // Не системная ошибка, соединение не разрывается
 )
 
 // Error - реализация интерфейса ошибки для c2c устройств
@@ -46,6 +49,16 @@ func (err C2cError) Error() string {
 	return err.text
 }
 
+// Code - тип ошибки, который передается клиенту в ответе ErrorCOMMAND
+func (err C2cError) Code() uint16 {
+	return err.ErrType
+}
+
+// IsCritical - после системных ошибок соединение разрывается
+func (err C2cError) IsCritical() bool {
+	return err.ErrType >= DisableConnectionErrorLimit && err.ErrType <= NilMessageError
+}
+
 // NewC2cError Создание новой ошибки
 func NewC2cError(t uint16, text string) error {
 	return C2cError{
@@ -65,50 +78,105 @@ func Errorf(t uint16, format string, data ...interface{}) error {
 // C2cDevice - Сущность реализующая интерфейс клиента для двустороннего обмена сообщениями
 // и интерфейс ClientListenerInterface для добавления его в кеш
 type C2cDevice struct {
-	sessionID    uint32
-	clientType   data.ClientType
-	storage      data.DB
-	device       dto.ClientDescriptor // Номер устройства
-	readChan     chan dto.Message
-	listenerList map[uint64]*chan dto.Message // Список каналов устройств слушающих отправляемые сообщения этого клиента
-	listenerMtx  sync.RWMutex                 // Для защиты списка каналов устройств слушающих сообщения этого клиента
+	sessionID     uint32
+	remoteAddr    string   // Адрес клиента в сети
+	certNames     []string // Имена клиента из проверенного сертификата TLS сессии
+	clientType    data.ClientType
+	storage       data.DB
+	device        dto.ClientDescriptor           // Номер устройства
+	peer          string                         // Имя соседнего сервера, если это входящее соединение федерации
+	deviceMtx     sync.RWMutex                   // Для защиты device и peer, их меняет горутина сессии, а читают и другие горутины
+	nonce         string                         // Выданный клиенту nonce для авторизации
+	nonceDeadline time.Time                      // Время до которого nonce действителен
+	resumeToken   string                         // Токен для продолжения сессии после разрыва соединения
+	queue         *client.Queue                  // Очередь сообщений к этому клиенту
+	listenerList  map[uint64][]*client.Queue     // Очереди всех сессий устройств слушающих отправляемые сообщения этого клиента
+	remoteList    map[remoteClient]*client.Queue // Очереди соседей для подключенных к этому клиенту клиентов соседних серверов
+	listenerMtx   sync.RWMutex                   // Для защиты списков очередей устройств слушающих сообщения этого клиента
+	kicked        chan struct{}                  // Закрывается, когда клиент вошел в новой сессии и эта сессия должна завершиться
+	kickOnce      sync.Once
+	done          chan struct{} // Закрывается, когда соединение сессии закрыто
 }
 
 // AddListener - Добавляет нового слушателя в список подписчиков для раздачи данных
-func (c *C2cDevice) AddListener(from uint64, ch *chan dto.Message) {
-	if ch != nil {
+func (c *C2cDevice) AddListener(from uint64, q *client.Queue) {
+	if q != nil {
 		c.listenerMtx.Lock()
-		c.listenerList[from] = ch
+		if indexOfQueue(c.listenerList[from], q) < 0 {
+			c.listenerList[from] = append(c.listenerList[from], q)
+		}
 		c.listenerMtx.Unlock()
-		log.Tracef("Add channel from client %x to %x name %s", from, c.device.ID, c.device.Name)
+		id, name, _ := c.identity()
+		log.Tracef("Add queue from client %x to %x name %s", from, id, name)
 	}
 }
 
-// DelListener - Удаляем слушателя из списка подписчиков для конкретного клиента
-func (c *C2cDevice) DelListener(from uint64) {
+// DelListener - Удаляем очередь q слушателя из списка подписчиков для конкретного клиента, если q == nil удаляем все его очереди
+func (c *C2cDevice) DelListener(from uint64, q *client.Queue) {
 	c.listenerMtx.Lock()
-	delete(c.listenerList, from)
+	list := c.listenerList[from]
+	if i := indexOfQueue(list, q); q != nil && i >= 0 {
+		list = append(list[:i], list[i+1:]...)
+	}
+	if q == nil || len(list) == 0 {
+		delete(c.listenerList, from)
+	} else {
+		c.listenerList[from] = list
+	}
 	c.listenerMtx.Unlock()
-	log.Tracef("Delete channel from client %x for %s", from, c.device.Name)
+	_, name, _ := c.identity()
+	log.Tracef("Delete queue from client %x for %s", from, name)
+}
+
+func indexOfQueue(list []*client.Queue, q *client.Queue) int {
+	for i, val := range list {
+		if val == q {
+			return i
+		}
+	}
+	return -1
 }
 
-// GetListenerChan - Необходим для подключения одного клиента к другому в кеше клиентов
-func (c *C2cDevice) GetListenerChan() *chan dto.Message {
-	return &c.readChan
+// GetQueue - Необходим для подключения одного клиента к другому в кеше клиентов
+func (c *C2cDevice) GetQueue() *client.Queue {
+	return c.queue
 }
 
-// NewC2cDevice - Конструктор нового клеинта
-func NewC2cDevice(db data.DB, sessionID uint32, maxConnection uint32) client.ReadWriteCloser {
-	clType := cf.Config.ClientType
+// spill - сохраняет в базе сообщение, которое не поместилось в очередь. Клиент получит его после следующего сообщения
+func (c *C2cDevice) spill(m dto.Message) bool {
+	id := c.device.ID
+	if id == 0 || len(m.Content) == 0 {
+		return false
+	}
+	if m.Command != dto.DataCOMMAND && m.Command != dto.SaveDataCOMMAND && m.Command != dto.PropertiesCOMMAND {
+		return false
+	}
+	if _, err := c.storage.Add(id, dto.UnSendedMsg{Proto: m.Proto, Command: m.Command, From: m.From, Content: m.Content}); err != nil {
+		log.Error(err.Error())
+		return false
+	}
+	log.Infof("Queue to %s is full, message from %s is saved", c.device.Name, m.From)
+	return true
+}
+
+// NewC2cDevice - Конструктор нового клеинта. certNames - имена из проверенного сертификата клиента, если он есть
+func NewC2cDevice(db data.DB, sessionID uint32, maxConnection uint32, remoteAddr string, certNames []string) client.ReadWriteCloser {
+	clType := cf.Get().ClientType
 	if clType == 0 {
 		log.Error("Clinet type for this server does not specified. Registartion is disabled")
 	}
 	var c = new(C2cDevice)
 	c.sessionID = sessionID
+	c.remoteAddr = remoteAddr
+	c.certNames = certNames
 	c.storage = db
-	c.readChan = make(chan dto.Message, maxConnection) // Делаем его буферизированным, чтобы много узлов смогли отпраить ему сообщение
-	c.listenerList = make(map[uint64]*chan dto.Message)
+	c.queue = client.NewQueue(int(maxConnection), int(cf.Get().MaxLinkPacketSize), cf.Get().QueueOverflow, c.spill) // Отправители никогда не ждут медленного клиента
+	c.listenerList = make(map[uint64][]*client.Queue)
+	c.remoteList = make(map[remoteClient]*client.Queue)
+	c.kicked = make(chan struct{})
+	c.done = make(chan struct{})
 	c.clientType = data.ClientType(clType)
+	devices.add(c)
 	return c
 }
 
@@ -117,6 +185,10 @@ func (c *C2cDevice) Write(msg *dto.Message) error {
 	if msg == nil {
 		return Errorf(NilMessageError, "Message is nil in session %d", c.sessionID)
 	}
+	if len(c.peer) != 0 { // Сообщения соседнего сервера обрабатывает федерация
+		return peers.handle(c.peer, msg)
+	}
+	msg.ID = 0 // Идентификатор сообщения назначает сервер
 	switch msg.Command {
 	case dto.ErrorCOMMAND:
 		return c.errorHandler(msg)
@@ -127,9 +199,9 @@ func (c *C2cDevice) Write(msg *dto.Message) error {
 	case dto.ConnectByNameCOMMAND: // Content[0] - from name, Content[1] - to name
 		return c.connectByName(msg)
 	case dto.InitByIDCOMMAND: // Content[0] - from ID, Content[1] - to (server always "0")
-		return c.initByID(msg)
+		return authResult(c.initByID(msg))
 	case dto.InitByNameCOMMAND: // Content[0] - from name, Content[1] - to (server always "0")
-		return c.initByName(msg)
+		return authResult(c.initByName(msg))
 	case dto.RegisterCOMMAND:
 		if c.clientType != 0 {
 			return c.registerNewDevice(msg) // Content[0] - from name, Content[1] - to (server always "0") , Content[2] - BASE64(SHA256(name+password))
@@ -148,6 +220,22 @@ func (c *C2cDevice) Write(msg *dto.Message) error {
 		return c.destroyConnection(msg) //Content[0] - from: local ID or Name, Content[1] - destroy connection from who.
 	case dto.PropertiesCOMMAND:
 		return c.setProperies(msg) //Content[0] - from: local ID or Name, Content[1] - to
+	case dto.AccessCOMMAND:
+		return c.access(msg) // Content - изменения правил доступа к этому клиенту
+	case dto.ApproveCOMMAND:
+		return c.approve(msg) // m.To - идентификатор запросившего соединение, Content - ACCEPT или REJECT
+	case dto.SubscribeCOMMAND:
+		return c.subscribe(msg) // m.To - имя топика
+	case dto.UnsubscribeCOMMAND:
+		return c.unsubscribe(msg) // m.To - имя топика
+	case dto.PublishCOMMAND:
+		return c.publish(msg) // m.To - имя топика
+	case dto.PresenceCOMMAND:
+		return c.presence(msg) // m.To - идентификатор или имя клиента
+	case dto.ResumeCOMMAND:
+		return authResult(c.resume(msg)) // m.From - идентификатор или имя клиента, Content - токен
+	case dto.PeerInitCOMMAND:
+		return authResult(c.initPeer(msg)) // m.From - имя соседнего сервера, Content - salt;signature
 	default:
 		return Errorf(UnsupportedCommandError, "Unsupported command %d in session %d", msg.Command, c.sessionID)
 	}
@@ -161,38 +249,102 @@ func (c *C2cDevice) Write(msg *dto.Message) error {
 func (c *C2cDevice) Read(ctx context.Context, handler dto.ClientReadHandler) {
 	for {
 		select {
-		case m, ok := <-c.readChan:
-			if !ok {
-				log.Tracef("Read channel is closed for device %x name %s for session %d", c.device.ID, c.device.Name, c.sessionID)
-				handler(dto.Message{}, io.EOF)
-				return
-			}
-			if err := handler(m, nil); err != nil {
-				return
+		case <-c.queue.Ready():
+			for m, ok := c.queue.Get(); ok; m, ok = c.queue.Get() {
+				if err := handler(m, nil); err != nil {
+					return
+				}
+				if m.Command == dto.ShutdownCOMMAND { // Сервер останавливается, клиент получил все, что было до уведомления
+					handler(dto.Message{}, io.EOF)
+					return
+				}
 			}
+		case <-c.queue.Done():
+			id, name, _ := c.identity() // Сессия закрывается в горутине записи
+			log.Tracef("Read queue is closed for device %x name %s for session %d", id, name, c.sessionID)
+			handler(dto.Message{}, io.EOF)
+			return
+		case <-c.kicked:
+			_, name, _ := c.identity()
+			log.Infof("Client %s logged in from another session, close session %d", name, c.sessionID)
+			handler(dto.Message{}, io.EOF)
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// Close - информирует про разрыв соединения и закрываем канал
+// Close - информирует про разрыв соединения и закрываем очередь
 func (c *C2cDevice) Close() error {
-	c.destroyConnection(&dto.Message{
-		From:    c.device.Name,
-		To:      "0",
-		Command: dto.DestroyConCOMMAND,
-		Jmp:     1, // TODO set Jmp obviously is a bad practice
-		Proto:   1, // TODO set Proto obviously is a bad practice
-	})
-	connection.DelClientFromCashe(c.device.ID)
-	close(c.readChan)
+	devices.del(c)
+	defer close(c.done)
+	if c.isKicked() { // Клиент продолжает работу в новой сессии
+		c.queue.Close()
+		log.Infof("Close kicked session %d of client %s", c.sessionID, c.device.Name)
+		return nil
+	}
+	if c.park() { // Клиент может продолжить сессию в течении ResumeTimeOut
+		return nil
+	}
+	return c.shutdown()
+}
+
+// shutdown - отключает клиента от всех и удаляет его из кеша онлайн клиентов
+func (c *C2cDevice) shutdown() error {
+	last := connection.DelClientFromCashe(c.device.ID, c) == 0
+	if last { // Другие сессии клиента продолжают работу со всеми подключенными к нему
+		c.notifyPresence(presenceOffline)
+		if c.device.ID != 0 {
+			if err := c.storage.SetLastSeen(c.device.ID, time.Now(), c.remoteAddr); err != nil {
+				log.Warning(err.Error())
+			}
+		}
+		c.destroyConnection(&dto.Message{
+			From:    c.device.Name,
+			To:      "0",
+			Command: dto.DestroyConCOMMAND,
+			Jmp:     1, // TODO set Jmp obviously is a bad practice
+			Proto:   1, // TODO set Proto obviously is a bad practice
+		})
+	}
+	topics.leaveAll(c.queue)
+	c.queue.Close()
+	if last { // Пока клиент на связи, недоставленные сообщения получат другие его сессии
+		c.saveUndelivered()
+	}
 	log.Infof("Close client %s with id %d in session %d", c.device.Name, c.device.ID, c.sessionID)
+	c.deviceMtx.Lock()
 	c.device.ID = 0
+	c.deviceMtx.Unlock()
 	return nil
 }
 
+// setDevice - клиент сессии после авторизации. device и peer меняет только горутина сессии,
+// поэтому она читает их напрямую, а остальные горутины через identity
+func (c *C2cDevice) setDevice(dev dto.ClientDescriptor) {
+	c.deviceMtx.Lock()
+	c.device = dev
+	c.deviceMtx.Unlock()
+}
+
+// resetDevice - сбрасывает клиента сессии после неудачной авторизации
+func (c *C2cDevice) resetDevice() {
+	c.deviceMtx.Lock()
+	c.device.ID = 0
+	c.device.Name = ""
+	c.deviceMtx.Unlock()
+}
+
+// identity - идентификатор и имя клиента, имя соседнего сервера. Можно вызывать из любой горутины
+func (c *C2cDevice) identity() (id uint64, name string, peer string) {
+	c.deviceMtx.RLock()
+	defer c.deviceMtx.RUnlock()
+	return c.device.ID, c.device.Name, c.peer
+}
+
 // GetID - возвращет идентификатор текущего клиента
 func (c *C2cDevice) GetID() uint64 {
-	return c.device.ID
+	id, _, _ := c.identity()
+	return id
 }
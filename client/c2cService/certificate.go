@@ -0,0 +1,79 @@
+package c2cService
+
+import (
+	"strings"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Авторизация клиентов по сертификату (mTLS).
+// Если задан ClientCAPath, TLS и WSS клиенты могут предъявить сертификат, подписанный одним из центров сертификации.
+// Имена из проверенного сертификата (CN или SAN, см. ClientCertName) сопоставляются с именами клиентов.
+// ClientCertAuth = cert - клиенту, имя которого есть в сертификате, не нужен пароль: на запрос nonce (InitByName
+// или InitByID с пустым Content) сервер сразу отвечает INIT OK;;токен (или 0;;токен), подписи сервера в ответе нет.
+// ClientCertAuth = both - клиент проходит обычную авторизацию по паролю, но войти или зарегистрироваться
+// можно только под именем из сертификата, сессии без сертификата войти не могут
+
+const certAuthOnly = "cert"
+const certAuthBoth = "both"
+
+// certAuth - режим авторизации по сертификату, пустая строка если сертификаты клиентов не проверяются
+func certAuth() string {
+	if len(cf.Get().ClientCAPath) == 0 {
+		return ""
+	}
+	if len(cf.Get().ClientCertAuth) == 0 {
+		return certAuthOnly
+	}
+	return strings.ToLower(cf.Get().ClientCertAuth)
+}
+
+// hasCertName - true если сертификат сессии выдан клиенту name. Имена клиентов чувствительны к регистру
+func (c *C2cDevice) hasCertName(name string) bool {
+	for _, val := range c.certNames {
+		if len(name) != 0 && val == name {
+			return true
+		}
+	}
+	return false
+}
+
+// certLogin - true если клиент name может войти по сертификату без пароля
+func (c *C2cDevice) certLogin(name string) bool {
+	return certAuth() == certAuthOnly && c.hasCertName(name)
+}
+
+// checkCert - в режиме both клиент name должен предъявить свой сертификат
+func (c *C2cDevice) checkCert(name string) error {
+	if certAuth() != certAuthBoth || c.hasCertName(name) {
+		return nil
+	}
+	err := Errorf(InvalidCredentials, "Client %s has no certificate in session %d", name, c.sessionID)
+	log.Warning(err.Error())
+	return err
+}
+
+// initByCert - вход клиента c.device по сертификату сессии, answer - ответ на команду инициализации
+func (c *C2cDevice) initByCert(m *dto.Message, answer string) error {
+	if er := c.addToCache(); er != nil {
+		log.Error(er.Error())
+		c.resetDevice()
+		return er
+	}
+	c.queue.Put(dto.Message{
+		Command: m.Command,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.From,
+		Content: []byte(c.withResumeToken(answer + ";")),
+	})
+	c.restoreTopics()
+	if len(connection.GetSessions(c.device.ID)) == 1 { // Остальные сессии клиента уже в сети
+		c.notifyPresence(presenceOnline)
+	}
+	log.Infof("Client %s init by certificate ok in session %d", c.device.Name, c.sessionID)
+	return nil
+}
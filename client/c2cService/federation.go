@@ -0,0 +1,718 @@
+package c2cService
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blabu/egeonC2cService/client"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/data"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+	"github.com/blabu/egeonC2cService/parser"
+)
+
+// Федерация серверов.
+// Каждый сервер сам подключается к соседям из PeerServers и отправляет им сообщения только через свои исходящие соединения.
+// Входящие соединения соседей (сессии после команды PeerInitCOMMAND) используются только для приема,
+// поэтому соседи должны быть прописаны в конфигурации обоих серверов.
+// Если адресат не найден локально запрос рассылается всем соседям с уменьшенным счетчиком прыжков.
+// Каждое пересылаемое сообщение получает случайный идентификатор, повторно пришедшие сообщения отбрасываются.
+// Идентификаторы клиентов разных серверов могут совпадать, поэтому локальные клиенты получают сообщения клиентов
+// соседей с адресом ID@имя соседа и могут отвечать как на этот адрес, так и на ID, если локального клиента с таким ID нет.
+
+const (
+	peerProto          = 2               // Соседи общаются в бинарной версии протокола
+	peerAnswerJmp      = 8               // Счетчик прыжков для ответов на запросы соседей
+	peerReconnectDelay = 5 * time.Second // Пауза перед повторным подключением к соседу
+	peerSeenTTL        = time.Minute     // Время хранения идентификаторов пересланных сообщений
+)
+
+// peerLink - исходящее соединение с соседним сервером.
+// Очередь out живет все время работы сервера и используется как очередь слушателя
+// для клиентов подключенных через этого соседа, пока соседа нет на связи сообщения отбрасываются
+type peerLink struct {
+	addr string
+	name string
+	out  *client.Queue
+}
+
+// send - не блокирующая отправка сообщения соседу
+func (l *peerLink) send(m dto.Message) {
+	l.out.Put(m)
+}
+
+// pendingConnect - запрос соединения локального клиента, отправленный соседям
+type pendingConnect struct {
+	command uint16
+	from    string // Отправитель так как он был указан в запросе
+	target  string // Адресат так как он был указан в запросе
+	proto   uint16
+	jmp     uint16
+	session *C2cDevice // Сессия, запросившая соединение
+	timer   *time.Timer
+}
+
+// remoteClient - клиент соседнего сервера, подключенный к локальному клиенту
+type remoteClient struct {
+	peer string
+	id   uint64
+}
+
+// String - адрес клиента соседа для локальных клиентов ID@имя соседа
+func (r remoteClient) String() string {
+	return strconv.FormatUint(r.id, 16) + "@" + r.peer
+}
+
+// parseRemote - разбирает адрес клиента соседа ID@имя соседа
+func parseRemote(addr string) (remoteClient, bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 || i == len(addr)-1 {
+		return remoteClient{}, false
+	}
+	id, err := strconv.ParseUint(addr[:i], 16, 64)
+	if err != nil {
+		return remoteClient{}, false
+	}
+	return remoteClient{peer: addr[i+1:], id: id}, true
+}
+
+// matchRemote - клиенты соседей с адресом to: ID@имя соседа или ID клиента любого соседа
+func matchRemote(to string) func(r remoteClient) bool {
+	if res, ok := parseRemote(to); ok {
+		return func(r remoteClient) bool { return r == res }
+	}
+	id, err := strconv.ParseUint(to, 16, 64)
+	return func(r remoteClient) bool { return err == nil && r.id == id }
+}
+
+func anyRemote(remoteClient) bool { return true }
+
+// addRemote - подключает клиента соседа r, его сообщения отправляются в очередь соседа q
+func (c *C2cDevice) addRemote(r remoteClient, q *client.Queue) {
+	c.listenerMtx.Lock()
+	c.remoteList[r] = q
+	c.listenerMtx.Unlock()
+	log.Tracef("Add remote client %s to session %d", r, c.sessionID)
+}
+
+// hasRemote - true если клиент соседа r подключен к этому клиенту
+func (c *C2cDevice) hasRemote(r remoteClient) bool {
+	c.listenerMtx.RLock()
+	defer c.listenerMtx.RUnlock()
+	_, ok := c.remoteList[r]
+	return ok
+}
+
+// putRemote - передает m всем подключенным клиентам соседей, для которых match вернет true,
+// вернет их количество. Вызывается под listenerMtx
+func (c *C2cDevice) putRemote(m dto.Message, match func(r remoteClient) bool) int {
+	cnt := 0
+	for r, q := range c.remoteList {
+		if match(r) {
+			m.To = strconv.FormatUint(r.id, 16) // Сосед адресует своих клиентов только по идентификатору
+			q.Put(m)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// dropRemote - отключает клиентов соседей, для которых match вернет true. Вызывается под listenerMtx
+func (c *C2cDevice) dropRemote(match func(r remoteClient) bool) {
+	for r := range c.remoteList {
+		if match(r) {
+			delete(c.remoteList, r)
+		}
+	}
+}
+
+type federation struct {
+	db      data.DB
+	links   map[string]*peerLink         // Исходящие соединения по имени соседа
+	dialers map[string]chan struct{}     // Закрытие канала останавливает соединение с соседом по адресу из PeerServers
+	pending map[uint64][]*pendingConnect // Ожидающие ответа запросы соединения по идентификатору локального клиента
+	seen    map[uint64]time.Time         // Идентификаторы уже обработанных сообщений
+	pruned  time.Time
+	mtx     sync.Mutex
+}
+
+var peers = federation{
+	links:   make(map[string]*peerLink),
+	dialers: make(map[string]chan struct{}),
+	pending: make(map[uint64][]*pendingConnect),
+	seen:    make(map[uint64]time.Time),
+}
+
+// StartFederation - подключается ко всем соседям из конфигурации
+func StartFederation(db data.DB) {
+	peers.db = db
+	UpdatePeers()
+}
+
+// UpdatePeers - подключается к новым соседям из PeerServers и отключается от соседей, удаленных из конфигурации
+func UpdatePeers() {
+	if len(cf.Get().ServerName) == 0 || len(cf.Get().PeerSecret) == 0 {
+		if len(cf.Get().PeerServers) != 0 {
+			log.Error("ServerName and PeerSecret must be specified for federation. Peer servers are ignored")
+		}
+		return
+	}
+	list := make(map[string]bool)
+	for _, addr := range cf.Get().PeerServers {
+		list[addr] = true
+	}
+	peers.mtx.Lock()
+	defer peers.mtx.Unlock()
+	for addr, stop := range peers.dialers {
+		if !list[addr] {
+			close(stop)
+			delete(peers.dialers, addr)
+			log.Infof("Peer %s is removed from configuration, disconnect", addr)
+		}
+	}
+	for addr := range list {
+		if _, ok := peers.dialers[addr]; !ok {
+			stop := make(chan struct{})
+			peers.dialers[addr] = stop
+			go peers.dial(addr, stop)
+		}
+	}
+}
+
+// stopPeers - отключается от всех соседей при остановке сервера
+func stopPeers() {
+	peers.mtx.Lock()
+	defer peers.mtx.Unlock()
+	for addr, stop := range peers.dialers {
+		close(stop)
+		delete(peers.dialers, addr)
+	}
+}
+
+func peerTimeout() time.Duration {
+	if cf.Get().PeerTimeout == 0 {
+		return cf.DefaultPeerTimeout * time.Second
+	}
+	return time.Duration(cf.Get().PeerTimeout) * time.Second
+}
+
+// peerSignature - base64(HMAC-SHA256(PeerSecret, name + nonce))
+func peerSignature(name, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(cf.Get().PeerSecret))
+	mac.Write([]byte(name + nonce))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkPeerSignature - сравнивает подпись соседа с ожидаемой за постоянное время
+func checkPeerSignature(name, nonce, sign string) bool {
+	return hmac.Equal([]byte(sign), []byte(peerSignature(name, nonce)))
+}
+
+func randomID() uint64 {
+	var buf [8]byte
+	for {
+		rand.Read(buf[:])
+		if id := binary.LittleEndian.Uint64(buf[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+func (f *federation) enabled() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.links) != 0
+}
+
+// isSeen - отмечает сообщение обработанным, вернет true если оно уже приходило
+func (f *federation) isSeen(id uint64) bool {
+	if id == 0 {
+		return false
+	}
+	now := time.Now()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if now.Sub(f.pruned) > peerSeenTTL {
+		for k, t := range f.seen {
+			if now.Sub(t) > peerSeenTTL {
+				delete(f.seen, k)
+			}
+		}
+		f.pruned = now
+	}
+	if _, ok := f.seen[id]; ok {
+		return true
+	}
+	f.seen[id] = now
+	return false
+}
+
+// broadcast - отправляет сообщение всем соседям кроме source
+func (f *federation) broadcast(source string, m dto.Message) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for name, l := range f.links {
+		if name != source {
+			l.send(m)
+		}
+	}
+}
+
+func (f *federation) link(name string) *peerLink {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.links[name]
+}
+
+// forward - пересылает сообщение локального клиента соседям, если адресат не найден на этом сервере
+func (f *federation) forward(c *C2cDevice, m *dto.Message) bool {
+	if m.Jmp == 0 || !f.enabled() {
+		return false
+	}
+	msg := *m
+	msg.From = strconv.FormatUint(c.device.ID, 16)
+	msg.ID = randomID()
+	f.isSeen(msg.ID)
+	f.broadcast("", msg)
+	log.Infof("Message %x from %s to %s forwarded to peers", msg.ID, m.From, m.To)
+	return true
+}
+
+// forwardConnect - отправляет запрос соединения соседям и ждет ответа не дольше PeerTimeout.
+// Запрос регистрируется вместе с таймером до отправки, чтобы ответ соседа не пришел раньше
+func (f *federation) forwardConnect(c *C2cDevice, m *dto.Message) bool {
+	if m.Jmp == 0 || !f.enabled() {
+		return false
+	}
+	id := c.device.ID
+	p := &pendingConnect{
+		command: m.Command,
+		from:    m.From,
+		target:  m.To,
+		proto:   m.Proto,
+		jmp:     m.Jmp,
+		session: c,
+	}
+	f.mtx.Lock()
+	p.timer = time.AfterFunc(peerTimeout(), func() {
+		if !f.removePending(id, p) {
+			return
+		}
+		req := dto.Message{From: p.from, Proto: p.proto, Jmp: p.jmp}
+		p.session.GetQueue().Put(client.ErrorMessage(&req, ClientNotFindError, "Client "+p.target+" not found"))
+	})
+	f.pending[id] = append(f.pending[id], p)
+	f.mtx.Unlock()
+	return f.forward(c, m)
+}
+
+func (f *federation) removePending(id uint64, p *pendingConnect) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	list := f.pending[id]
+	for i, val := range list {
+		if val == p {
+			list = append(list[:i], list[i+1:]...)
+			if len(list) == 0 {
+				delete(f.pending, id)
+			} else {
+				f.pending[id] = list
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// takePending - ищет запрос соединения на который пришел ответ от соседа
+func (f *federation) takePending(m *dto.Message) *pendingConnect {
+	id, err := strconv.ParseUint(m.To, 16, 64)
+	if err != nil {
+		return nil
+	}
+	f.mtx.Lock()
+	var res *pendingConnect
+	for _, p := range f.pending[id] {
+		if p.command != m.Command {
+			continue
+		}
+		if p.command == dto.ConnectByNameCOMMAND || strings.EqualFold(p.target, m.From) {
+			res = p
+			break
+		}
+	}
+	f.mtx.Unlock()
+	if res == nil || !f.removePending(id, res) {
+		return nil
+	}
+	res.timer.Stop()
+	return res
+}
+
+// handle - обработка сообщения, пришедшего от соседнего сервера source
+func (f *federation) handle(source string, m *dto.Message) error {
+	if f.isSeen(m.ID) {
+		return nil
+	}
+	switch m.Command {
+	case dto.PingCOMMAND:
+		return nil
+	case dto.ConnectByIDCOMMAND, dto.ConnectByNameCOMMAND:
+		if f.completeConnect(source, m) || f.acceptConnect(source, m) {
+			return nil
+		}
+	case dto.DataCOMMAND, dto.SaveDataCOMMAND, dto.PropertiesCOMMAND, dto.DestroyConCOMMAND, dto.PresenceCOMMAND:
+		if f.deliverLocal(source, m) {
+			return nil
+		}
+	default:
+		log.Warningf("Unsupported command %d from peer %s", m.Command, source)
+		return nil
+	}
+	if m.Jmp > 0 {
+		f.broadcast(source, *m)
+	}
+	return nil
+}
+
+// completeConnect - ответ соседа на запрос соединения локального клиента
+func (f *federation) completeConnect(source string, m *dto.Message) bool {
+	answer := answerConnectByIDOk
+	if m.Command == dto.ConnectByNameCOMMAND {
+		answer = answerConnectByNameOk
+	}
+	if string(m.Content) != answer {
+		return false
+	}
+	p := f.takePending(m)
+	if p == nil {
+		return false
+	}
+	localID, _ := strconv.ParseUint(m.To, 16, 64)
+	remoteID, err := strconv.ParseUint(m.From, 16, 64)
+	l := f.link(source)
+	cl := p.session
+	if cl.GetID() != localID || l == nil || err != nil {
+		log.Warningf("Can not finish connection %s with %s through peer %s", p.from, p.target, source)
+		return true
+	}
+	cl.addRemote(remoteClient{peer: source, id: remoteID}, l.out)
+	cl.GetQueue().Put(dto.Message{
+		Command: m.Command,
+		Jmp:     p.jmp,
+		Proto:   p.proto,
+		From:    p.target,
+		To:      p.from,
+		Content: m.Content,
+	})
+	log.Infof("Connect %s with remote %s through peer %s finished fine", p.from, p.target, source)
+	return true
+}
+
+// acceptConnect - запрос соединения от клиента соседа к локальному клиенту
+func (f *federation) acceptConnect(source string, m *dto.Message) bool {
+	localID := f.findID(m.To)
+	if localID == 0 {
+		return false
+	}
+	sessions := connection.GetSessions(localID)
+	if len(sessions) == 0 {
+		_, err := f.db.GetClient(localID)
+		return err == nil // Клиент зарегистрирован здесь, но не в сети. Дальше не пересылаем
+	}
+	remoteID, err := strconv.ParseUint(m.From, 16, 64)
+	if err != nil {
+		log.Warningf("Incorrect remote client %s from peer %s", m.From, source)
+		return true
+	}
+	if !isAllowed(f.db, localID, remoteID) {
+		log.Warningf("Remote client %s from peer %s can not connect to %x", m.From, source, localID)
+		return true
+	}
+	l := f.link(source)
+	if l == nil {
+		log.Warningf("Outgoing connection to peer %s is undefined. Add it to PeerServers", source)
+		return true
+	}
+	for _, cl := range sessions {
+		if dev, ok := cl.(*C2cDevice); ok {
+			dev.addRemote(remoteClient{peer: source, id: remoteID}, l.out)
+		}
+	}
+	answer := answerConnectByIDOk
+	if m.Command == dto.ConnectByNameCOMMAND {
+		answer = answerConnectByNameOk
+	}
+	l.send(dto.Message{
+		ID:      randomID(),
+		Command: m.Command,
+		Proto:   peerProto,
+		Jmp:     peerAnswerJmp,
+		From:    strconv.FormatUint(localID, 16),
+		To:      m.From,
+		Content: []byte(answer),
+	})
+	log.Infof("Remote client %s from peer %s connected to %x", m.From, source, localID)
+	return true
+}
+
+// deliverLocal - передает сообщение от клиента соседа source локальному адресату.
+// Вернет false если адресат не зарегистрирован на этом сервере
+func (f *federation) deliverLocal(source string, m *dto.Message) bool {
+	localID := f.findID(m.To)
+	if localID == 0 {
+		return false
+	}
+	remoteID, _ := strconv.ParseUint(m.From, 16, 64)
+	remote := remoteClient{peer: source, id: remoteID}
+	msg := *m
+	msg.From = remote.String()
+	if sessions := connection.GetSessions(localID); len(sessions) != 0 {
+		delivered := false
+		for _, cl := range sessions {
+			if dev, ok := cl.(*C2cDevice); ok && dev.hasRemote(remote) {
+				if m.Command == dto.DestroyConCOMMAND {
+					dev.listenerMtx.Lock()
+					delete(dev.remoteList, remote)
+					dev.listenerMtx.Unlock()
+				}
+				cl.GetQueue().Put(msg)
+				delivered = true
+			}
+		}
+		if delivered {
+			return true
+		}
+	} else if _, err := f.db.GetClient(localID); err != nil {
+		return false
+	}
+	if len(m.Content) > 0 && (m.Command == dto.SaveDataCOMMAND || m.Command == dto.PropertiesCOMMAND) {
+		if _, err := f.db.Add(localID, dto.UnSendedMsg{Proto: m.Proto, Command: m.Command, From: msg.From, Content: m.Content}); err != nil {
+			log.Error(err.Error())
+		}
+		log.Infof("Message from remote %s to %x is saved", msg.From, localID)
+	}
+	return true
+}
+
+func (f *federation) findID(arg string) uint64 {
+	if id, err := strconv.ParseUint(arg, 16, 64); err == nil {
+		return id
+	}
+	if id, err := f.db.GetClientID(arg); err == nil {
+		return id
+	}
+	return 0
+}
+
+// dial - поддерживает исходящее соединение с соседом addr, пока не закрыт stop.
+// После остановки очередь соседа закрывается и сообщения его клиентам отбрасываются
+func (f *federation) dial(addr string, stop chan struct{}) {
+	l := &peerLink{addr: addr, out: client.NewQueue(int(cf.Get().MaxQueuePacketSize), int(cf.Get().MaxLinkPacketSize), client.OverflowDropNewest, nil)}
+	defer l.out.Close()
+	for {
+		select {
+		case <-stop:
+			log.Infof("Connection to peer %s is stopped", addr)
+			return
+		default:
+		}
+		conn, err := net.DialTimeout("tcp", addr, peerTimeout())
+		if err != nil {
+			log.Warningf("Can not connect to peer %s %v", addr, err)
+			l.drop(peerReconnectDelay, stop)
+			continue
+		}
+		p := parser.CreateEmptyParser(uint64(cf.Get().MaxPacketSize) * 1024)
+		r := bufio.NewReader(conn)
+		if l.name, err = l.handshake(conn, p, r); err != nil {
+			log.Warningf("Peer %s handshake failed %v", addr, err)
+			conn.Close()
+			l.drop(peerReconnectDelay, stop)
+			continue
+		}
+		f.mtx.Lock()
+		f.links[l.name] = l
+		f.mtx.Unlock()
+		log.Infof("Connected to peer %s at %s", l.name, addr)
+		l.serve(conn, p, r, f.db, stop)
+		f.mtx.Lock()
+		if f.links[l.name] == l {
+			delete(f.links, l.name)
+		}
+		f.mtx.Unlock()
+		conn.Close()
+		select {
+		case <-stop:
+		default:
+			log.Warningf("Connection to peer %s at %s is lost", l.name, addr)
+		}
+	}
+}
+
+// drop - отбрасывает сообщения пока соседа нет на связи. Ждет dT или закрытия stop
+func (l *peerLink) drop(dT time.Duration, stop chan struct{}) {
+	tm := time.NewTimer(dT)
+	defer tm.Stop()
+	for {
+		select {
+		case <-l.out.Ready():
+			for m, ok := l.out.Get(); ok; m, ok = l.out.Get() {
+				log.Warningf("Peer %s is offline, message from %s to %s dropped", l.addr, m.From, m.To)
+			}
+		case <-tm.C:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handshake - взаимная авторизация соседей по общему секрету, вернет имя соседа.
+// Сосед выдает nonce, который подписывается вместе со своим nonce, его в ответ подписывает сосед
+func (l *peerLink) handshake(conn net.Conn, p parser.Parser, r *bufio.Reader) (string, error) {
+	conn.SetDeadline(time.Now().Add(peerTimeout()))
+	defer conn.SetDeadline(time.Time{})
+	request := func(content string) (dto.Message, error) {
+		req, _ := p.FormMessage(dto.Message{
+			Command: dto.PeerInitCOMMAND,
+			Proto:   peerProto,
+			Jmp:     2, // Nonce возвращается с уменьшенным счетчиком прыжков запроса
+			From:    cf.Get().ServerName,
+			To:      "0",
+			Content: []byte(content),
+		})
+		if _, err := conn.Write(req); err != nil {
+			return dto.Message{}, err
+		}
+		m, err := p.ReadMessage(r)
+		if err != nil {
+			return m, err
+		}
+		if m.Command != dto.PeerInitCOMMAND {
+			return m, Errorf(InvalidCredentials, "Unexpected answer %d %s", m.Command, m.Content)
+		}
+		return m, nil
+	}
+	m, err := request("")
+	if err != nil {
+		return "", err
+	}
+	nonce := strconv.FormatUint(randomID(), 16)
+	if m, err = request(string(m.Content) + ";" + peerSignature(cf.Get().ServerName, string(m.Content)) + ";" + nonce); err != nil {
+		return "", err
+	}
+	answer := strings.SplitN(string(m.Content), ";", 2)
+	if len(answer) != 2 || answer[0] != nonce || !checkPeerSignature(m.From, nonce, answer[1]) {
+		return "", NewC2cError(InvalidCredentials, "Incorrect peer signature")
+	}
+	return m.From, nil
+}
+
+// serve - передает сообщения соседу пока соединение живо и не закрыт stop
+func (l *peerLink) serve(conn net.Conn, p parser.Parser, r *bufio.Reader, db data.DB, stop chan struct{}) {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := p.ReadMessage(r); err != nil {
+				return
+			}
+		}
+	}()
+	period := time.Duration(cf.Get().SessionTimeOut) * time.Second / 3
+	if period <= 0 {
+		period = peerTimeout()
+	}
+	keepAlive := time.NewTicker(period)
+	defer keepAlive.Stop()
+	write := func(m dto.Message) bool {
+		m.Proto = peerProto
+		data, _ := p.FormMessage(m)
+		conn.SetWriteDeadline(time.Now().Add(peerTimeout()))
+		if _, err := conn.Write(data); err != nil {
+			log.Warningf("Can not send message to peer %s %v", l.name, err)
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case <-l.out.Ready():
+			for m, ok := l.out.Get(); ok; m, ok = l.out.Get() {
+				if _, err := strconv.ParseUint(m.From, 16, 64); err != nil {
+					if id, err := db.GetClientID(m.From); err == nil {
+						m.From = strconv.FormatUint(id, 16) // Соседи адресуют клиентов только по идентификатору
+					}
+				}
+				if m.ID == 0 {
+					m.ID = randomID()
+				}
+				if m.Jmp == 0 { // Счетчик прыжков исчерпан, сосед такое сообщение не примет
+					log.Infof("Message %x from %s to %s is not sent to peer %s, jump count is over", m.ID, m.From, m.To, l.name)
+					continue
+				}
+				if !write(m) {
+					return
+				}
+			}
+		case <-keepAlive.C:
+			if !write(dto.Message{Command: dto.PingCOMMAND, Jmp: 1, From: cf.Get().ServerName, To: "0"}) {
+				return
+			}
+		case <-closed:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// initPeer - входящее соединение от соседнего сервера.
+// Сначала сосед запрашивает nonce командой без данных,
+// затем отправляет Content: nonce;base64(HMAC-SHA256(PeerSecret, имя соседа + nonce));nonce соседа
+func (c *C2cDevice) initPeer(m *dto.Message) error {
+	if len(cf.Get().ServerName) == 0 || len(cf.Get().PeerSecret) == 0 {
+		return NewC2cError(UnsupportedCommandError, "Federation is disabled for this server")
+	}
+	if c.device.ID != 0 || len(c.peer) != 0 {
+		return Errorf(BadCommandError, "Session %d already initialized", c.sessionID)
+	}
+	if len(m.Content) == 0 {
+		return c.sendNonce(m, "")
+	}
+	credentials := strings.Split(string(m.Content), ";")
+	if len(credentials) < 3 {
+		return Errorf(InvalidCredentials, "Peer %s undefined signature in session %d", m.From, c.sessionID)
+	}
+	if !c.checkNonce(credentials[0]) {
+		return Errorf(InvalidCredentials, "Peer %s nonce is incorrect or expired in session %d", m.From, c.sessionID)
+	}
+	if !checkPeerSignature(m.From, credentials[0], credentials[1]) {
+		log.Warningf("Incorrect peer %s signature in session %d", m.From, c.sessionID)
+		return Errorf(InvalidCredentials, "Peer %s initialize fail in session %d", m.From, c.sessionID)
+	}
+	c.deviceMtx.Lock()
+	c.peer = m.From
+	c.deviceMtx.Unlock()
+	c.queue.Put(dto.Message{
+		Command: dto.PeerInitCOMMAND,
+		Proto:   m.Proto,
+		Jmp:     1,
+		From:    cf.Get().ServerName,
+		To:      m.From,
+		Content: []byte(credentials[2] + ";" + peerSignature(cf.Get().ServerName, credentials[2])),
+	})
+	log.Infof("Peer server %s connected in session %d", m.From, c.sessionID)
+	return nil
+}
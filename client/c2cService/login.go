@@ -0,0 +1,100 @@
+package c2cService
+
+import (
+	"strings"
+
+	"github.com/blabu/egeonC2cService/client"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/data"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Политика повторного входа клиента, который уже в сети.
+// reject - новая сессия получает ошибку ClientExcistError (по умолчанию)
+// kick - старая сессия закрывается, ее соединения с другими клиентами и подписки переходят к новой сессии
+// multiple - клиент работает в нескольких сессиях одновременно. Сообщения для клиента получают все его сессии,
+// соединения, созданные сессией, и ее подписки принадлежат только ей
+// Политика задается для типа клиента в LoginPolicies, для остальных типов действует LoginPolicy
+
+const loginReject = "reject"
+const loginKick = "kick"
+const loginMultiple = "multiple"
+
+// loginPolicy - политика повторного входа для клиента id
+func loginPolicy(id uint64) string {
+	clType, _ := data.SplitClientID(id)
+	if p, ok := cf.Get().LoginPolicies[uint16(clType)]; ok {
+		return strings.ToLower(p)
+	}
+	if len(cf.Get().LoginPolicy) == 0 {
+		return loginReject
+	}
+	return strings.ToLower(cf.Get().LoginPolicy)
+}
+
+// addToCache - добавляет инициализированного клиента в кеш онлайн клиентов с учетом политики повторного входа
+func (c *C2cDevice) addToCache() error {
+	for _, cl := range connection.GetSessions(c.device.ID) {
+		if cl == client.ListenerInterface(c) { // Клиент уже добавлен при регистрации в этой сессии
+			return nil
+		}
+	}
+	policy := loginPolicy(c.device.ID)
+	if policy == loginMultiple {
+		return connection.AddSession(c.device.ID, c)
+	}
+	c.dropParked() // Клиент вошел заново вместо продолжения сессии
+	err := connection.AddClientToCache(c.device.ID, c)
+	if err == nil {
+		return nil
+	}
+	if policy != loginKick {
+		log.Warning(err.Error())
+		return Errorf(ClientExcistError, "Client %s already online", c.device.Name)
+	}
+	old, err := connection.ReplaceClient(c.device.ID, c)
+	if err != nil { // Старая сессия успела закрыться сама
+		if err = connection.AddClientToCache(c.device.ID, c); err != nil {
+			log.Warning(err.Error())
+			return Errorf(ClientExcistError, "Client %s already online", c.device.Name)
+		}
+		return nil
+	}
+	for _, cl := range old {
+		if dev, ok := cl.(*C2cDevice); ok {
+			dev.moveTo(c)
+			log.Infof("Client %s moved from session %d to session %d", c.device.Name, dev.sessionID, c.sessionID)
+		}
+	}
+	return nil
+}
+
+// moveTo - передает соединения и подписки новой сессии того же клиента и закрывает эту сессию
+func (c *C2cDevice) moveTo(n *C2cDevice) {
+	c.kickOnce.Do(func() { close(c.kicked) })
+	c.listenerMtx.Lock()
+	list, remotes := c.listenerList, c.remoteList
+	c.listenerList = make(map[uint64][]*client.Queue)
+	c.remoteList = make(map[remoteClient]*client.Queue)
+	c.listenerMtx.Unlock()
+	for id, queues := range list {
+		for _, q := range queues {
+			n.AddListener(id, q)
+		}
+	}
+	for r, q := range remotes {
+		n.addRemote(r, q)
+	}
+	topics.replace(c.queue, n.queue)
+	c.queue.MoveTo(n.queue)
+}
+
+// isKicked - сессия закрыта, потому что клиент вошел в новой сессии
+func (c *C2cDevice) isKicked() bool {
+	select {
+	case <-c.kicked:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,36 @@
+package c2cService
+
+import (
+	"strconv"
+
+	"github.com/blabu/egeonC2cService/data"
+	"github.com/blabu/egeonC2cService/metrics"
+)
+
+// Метрики клиентской логики
+
+func init() {
+	metrics.OnlineClients.Set(onlineByType)
+}
+
+// authResult - учитывает неудачную авторизацию по типу ошибки и возвращает ошибку без изменений
+func authResult(err error) error {
+	if err != nil {
+		code := InternalError
+		if clientErr, ok := err.(C2cError); ok {
+			code = clientErr.ErrType
+		}
+		metrics.AuthFailures.With(strconv.FormatUint(uint64(code), 10)).Inc()
+	}
+	return err
+}
+
+// onlineByType - количество онлайн клиентов по типу клиента (старшие 16 бит идентификатора)
+func onlineByType() map[string]int {
+	res := make(map[string]int)
+	for id := range connection.GetOnline() {
+		clType, _ := data.SplitClientID(id)
+		res[strconv.FormatUint(uint64(clType), 10)]++
+	}
+	return res
+}
@@ -0,0 +1,70 @@
+package c2cService
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Авторизация по одноразовому случайному числу (nonce), выданному сервером.
+// 1. Клиент отправляет команду инициализации без данных, сервер отвечает той же командой, в данных nonce
+// 2. Клиент отправляет команду инициализации с данными nonce;подпись не позже NonceTimeOut секунд
+// Каждый nonce проверяется только один раз, после неудачной попытки надо запросить новый
+
+const nonceSize = 16 // Размер nonce в байтах
+
+func nonceTimeOut() time.Duration {
+	if cf.Get().NonceTimeOut == 0 {
+		return cf.DefaultNonceTimeOut * time.Second
+	}
+	return time.Duration(cf.Get().NonceTimeOut) * time.Second
+}
+
+// newNonce - выдает новый nonce для этой сессии, предыдущий становится недействительным
+func (c *C2cDevice) newNonce() (string, error) {
+	buf := make([]byte, nonceSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", Errorf(InternalError, "Can not generate nonce in session %d %v", c.sessionID, err)
+	}
+	c.nonce = hex.EncodeToString(buf)
+	c.nonceDeadline = time.Now().Add(nonceTimeOut())
+	return c.nonce, nil
+}
+
+// checkNonce - true если nonce выдан этой сессии и еще не истек. Повторно тот же nonce не принимается
+func (c *C2cDevice) checkNonce(nonce string) bool {
+	origin, deadline := c.nonce, c.nonceDeadline
+	c.nonce = ""
+	if len(origin) == 0 || time.Now().After(deadline) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(origin), []byte(nonce)) == 1
+}
+
+// sendNonce - ответ на запрос инициализации без данных. Клиент получает nonce, который должен подписать,
+// и параметры подписи params, если они нужны
+func (c *C2cDevice) sendNonce(m *dto.Message, params string) error {
+	nonce, err := c.newNonce()
+	if err != nil {
+		return err
+	}
+	content := nonce
+	if len(params) != 0 {
+		content += ";" + params
+	}
+	c.queue.Put(dto.Message{
+		Command: m.Command,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.From,
+		Content: []byte(content),
+	})
+	log.Tracef("Nonce for %s sent in session %d", m.From, c.sessionID)
+	return nil
+}
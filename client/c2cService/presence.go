@@ -0,0 +1,114 @@
+package c2cService
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Уведомления о появлении и отключении клиента (PresenceCOMMAND).
+// From - идентификатор клиента, Content - ONLINE;имя или OFFLINE;имя
+// Уведомления получают все подключенные к клиенту и подписчики топика presence:<идентификатор или имя клиента>.
+// Подписаться на уведомления можно только если разрешено подключение к клиенту. Если доступ отозван,
+// уведомления перестают приходить, а постоянная подписка не восстанавливается
+// Клиент может запросить текущее состояние другого клиента той же командой (см. presence)
+
+const presenceOnline = "ONLINE"
+const presenceOffline = "OFFLINE"
+
+const presenceTopicPrefix = "presence:"
+
+func presenceTopic(id uint64) string {
+	return presenceTopicPrefix + strconv.FormatUint(id, 16)
+}
+
+// isPresenceTopic - топик уведомлений о клиенте, публиковать в него может только сервер
+func isPresenceTopic(topic string) bool {
+	return strings.HasPrefix(topic, presenceTopicPrefix)
+}
+
+// presenceTarget - приводит топик уведомлений к виду presence:<идентификатор> и проверяет доступ к клиенту
+func (c *C2cDevice) presenceTarget(m *dto.Message) error {
+	target := c.findID(strings.TrimPrefix(m.To, presenceTopicPrefix))
+	if target == 0 {
+		return Errorf(ClientNotFindError, "Undefined client in topic %s", m.To)
+	}
+	if !isAllowed(c.storage, target, c.device.ID) {
+		return Errorf(AccessDeniedError, "Client %x can not watch client %x", c.device.ID, target)
+	}
+	m.To = presenceTopic(target)
+	return nil
+}
+
+// canWatch - true если клиент может подписаться на топик уведомлений topic вида presence:<идентификатор>
+func (c *C2cDevice) canWatch(topic string) bool {
+	target, err := strconv.ParseUint(strings.TrimPrefix(topic, presenceTopicPrefix), 16, 64)
+	return err == nil && isAllowed(c.storage, target, c.device.ID)
+}
+
+// notifyPresence - передает состояние клиента всем подключенным к нему и подписчикам его топика уведомлений
+func (c *C2cDevice) notifyPresence(state string) {
+	if c.device.ID == 0 {
+		return
+	}
+	from := strconv.FormatUint(c.device.ID, 16)
+	event := dto.Message{
+		Command: dto.PresenceCOMMAND,
+		Jmp:     1,
+		Proto:   1,
+		From:    from,
+		Content: []byte(state + ";" + c.device.Name),
+	}
+	c.listenerMtx.RLock()
+	for id, list := range c.listenerList {
+		event.To = strconv.FormatUint(id, 16)
+		for _, q := range list {
+			q.Put(event)
+		}
+	}
+	c.putRemote(event, anyRemote)
+	c.listenerMtx.RUnlock()
+	event.To = presenceTopic(c.device.ID)
+	cnt := topics.publish(c.queue, event, func(id uint64) bool { // Доступ к клиенту могли отозвать после подписки
+		return isAllowed(c.storage, c.device.ID, id)
+	})
+	log.Tracef("Client %s is %s, %d watchers notified", from, state, cnt)
+}
+
+// presence - запрос состояния клиента m.To (идентификатор или имя).
+// Ответ: ONLINE;имя или OFFLINE;имя;время последнего отключения (unix время в шестнадцатиричном виде);адрес клиента
+func (c *C2cDevice) presence(m *dto.Message) error {
+	if c.device.ID == 0 {
+		return NewC2cError(BadCommandError, "Initialize device at first")
+	}
+	target := c.findID(m.To)
+	if target == 0 {
+		return Errorf(ClientNotFindError, "Undefined client %s", m.To)
+	}
+	if !isAllowed(c.storage, target, c.device.ID) {
+		return Errorf(AccessDeniedError, "Client %x can not watch client %x", c.device.ID, target)
+	}
+	dev, err := c.storage.GetClient(target)
+	if err != nil {
+		log.Warning(err.Error())
+		return Errorf(ClientNotFindError, "Undefined client %s", m.To)
+	}
+	content := presenceOnline + ";" + dev.Name
+	if _, ok := connection.GetClient(target); !ok {
+		content = presenceOffline + ";" + dev.Name
+		if !dev.LastSeen.IsZero() {
+			content += ";" + strings.ToUpper(strconv.FormatInt(dev.LastSeen.Unix(), 16)) + ";" + dev.LastAddr
+		}
+	}
+	c.queue.Put(dto.Message{
+		Command: dto.PresenceCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    strconv.FormatUint(target, 16),
+		To:      m.From,
+		Content: []byte(content),
+	})
+	return nil
+}
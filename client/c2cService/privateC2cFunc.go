@@ -1,13 +1,12 @@
 package c2cService
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/blabu/egeonC2cService/auth"
 	"github.com/blabu/egeonC2cService/dto"
 	log "github.com/blabu/egeonC2cService/logWrapper"
 )
@@ -21,19 +20,17 @@ const answerConnectByNameOk string = "CONNECT OK"
 const answerInitByIDOk string = "0"
 const answerConnectByIDOk string = "0"
 
-const saltUniqCount = 3 /*Количество раз использования случайной соли при авторизации*/
-
 func (c *C2cDevice) ping(m *dto.Message) error {
 	if c.device.ID != 0 {
 		currTimeStr := strconv.FormatInt(time.Now().Unix(), 16)
-		c.readChan <- dto.Message{
+		c.queue.Put(dto.Message{
 			Command: dto.PingCOMMAND,
 			Proto:   m.Proto,
 			Jmp:     m.Jmp,
 			From:    "0",
 			To:      m.From,
 			Content: []byte(strings.ToUpper(currTimeStr)),
-		}
+		})
 		log.Tracef("Ping command from device %s, id %x", c.device.Name, c.device.ID)
 		return nil
 	}
@@ -59,18 +56,31 @@ func (c *C2cDevice) connectByID(m *dto.Message) error {
 		log.Warning(err.Error())
 		return Errorf(InvalidCredentials, "\"%s\" must be a number", m.To)
 	}
-	if err = connection.ConnectClients(to, from); err != nil {
+	if _, err = c.storage.GetClient(to); err != nil {
 		log.Warning(err.Error())
+		if peers.forwardConnect(c, m) {
+			return nil // Клиент не зарегистрирован на этом сервере, ищем его у соседей. Правила доступа проверит его сервер
+		}
 		return Errorf(ClientNotFindError, "Can not create connection from %d whith abonnent %d", from, to)
 	}
-	c.readChan <- dto.Message{
+	if !isAllowed(c.storage, to, from) {
+		if needApproval(c.storage, to) {
+			return c.askApproval(m, to)
+		}
+		return Errorf(AccessDeniedError, "Client %x can not connect to %x", from, to)
+	}
+	if err = connection.ConnectClients(to, from, c); err != nil {
+		log.Warning(err.Error())
+		return Errorf(ClientNotFindError, "Can not create connection from %d whith abonnent %d", from, to)
+	}
+	c.queue.Put(dto.Message{
 		Command: dto.ConnectByIDCOMMAND,
 		Jmp:     m.Jmp,
 		Proto:   m.Proto,
 		From:    m.To,
 		To:      m.From,
 		Content: []byte(answerConnectByIDOk),
-	}
+	})
 	log.Infof("Connect by ID command from device %d to device %d finished fine", from, to)
 	return nil
 }
@@ -86,39 +96,62 @@ func (c *C2cDevice) connectByName(m *dto.Message) error {
 	toClientID, err := c.storage.GetClientID(m.To)
 	if err != nil {
 		log.Warning(err.Error())
+		if peers.forwardConnect(c, m) {
+			return nil // Клиент не зарегистрирован на этом сервере, ищем его у соседей. Правила доступа проверит его сервер
+		}
 		return NewC2cError(ClientNotFindError, "Undefined target client")
 	}
-	if err := connection.ConnectClients(toClientID, c.device.ID); err != nil {
+	if !isAllowed(c.storage, toClientID, c.device.ID) {
+		if needApproval(c.storage, toClientID) {
+			return c.askApproval(m, toClientID)
+		}
+		return Errorf(AccessDeniedError, "Client %s can not connect to %s", m.From, m.To)
+	}
+	if err := connection.ConnectClients(toClientID, c.device.ID, c); err != nil {
 		log.Warning(err.Error())
 		return Errorf(ClientNotFindError, "Can not create connection from %s with abonnent %s", m.From, m.To)
 	}
-	c.readChan <- dto.Message{
+	c.queue.Put(dto.Message{
 		Command: dto.ConnectByNameCOMMAND,
 		Jmp:     m.Jmp,
 		Proto:   m.Proto,
 		From:    m.To,
 		To:      m.From,
 		Content: []byte(answerConnectByNameOk),
-	}
+	})
 	log.Infof("Connect by name command from device %s to device %s finished fine", m.From, m.To)
 	return nil
 }
 
-// For init by ID you need send ID (Content[0]), (salt ; signature)-(Content[2]) signature-base64(SHA256(ID + salt + base64(SHA256(name+password))))
+// For init by ID you need request nonce with empty content at first, answer is (nonce ; salt ; iterations).
+// Than send ID (m.From), (nonce ; proof)-(m.Content) proof - SCRAM-SHA-256 ClientProof for AuthMessage (ID + nonce), secret is base64(SHA256(name+password))
+// Answer is (0 ; ServerSignature) or (0 ; ServerSignature ; resume token) if ResumeTimeOut is set
 func (c *C2cDevice) initByID(m *dto.Message) error {
 	id, err := strconv.ParseUint(m.From, 16, 64)
 	if err != nil {
 		log.Warningf("Can not find corect ID in session %d %s", c.sessionID, err.Error())
 		return NewC2cError(InvalidCredentials, "ID must be a number")
 	}
-	credentials := strings.Split(string(m.Content), ";") // Разделим соль от подписи
+	if len(m.Content) == 0 { // Клиент запрашивает nonce для подписи
+		device, err := c.storage.GetClient(id)
+		if err != nil {
+			log.Warning(err.Error())
+			return NewC2cError(ClientNotFindError, err.Error())
+		}
+		if c.device.ID == 0 && c.certLogin(device.Name) {
+			c.setDevice(*device)
+			return c.initByCert(m, answerInitByIDOk)
+		}
+		return c.sendNonce(m, auth.Challenge(device))
+	}
+	credentials := strings.Split(string(m.Content), ";") // Разделим nonce от подписи
 	if len(credentials) < 2 {
 		err := Errorf(InvalidCredentials, "Client %d undefined signature for initialize in session %d", id, c.sessionID)
 		log.Warning(err.Error())
 		return err
 	}
-	if CheckSaltByID(id, credentials[0]) > saltUniqCount {
-		err := Errorf(InvalidCredentials, "Client %d salt already been used %d times in session %d", id, saltUniqCount, c.sessionID)
+	if !c.checkNonce(credentials[0]) {
+		err := Errorf(InvalidCredentials, "Client %d nonce is incorrect or expired in session %d", id, c.sessionID)
 		log.Warning(err.Error())
 		return err
 	}
@@ -128,53 +161,72 @@ func (c *C2cDevice) initByID(m *dto.Message) error {
 			log.Warning(err.Error())
 			return NewC2cError(ClientNotFindError, err.Error())
 		}
-		c.device = *device
+		c.setDevice(*device)
 	}
 	if c.device.ID == id {
-		var credBuilder strings.Builder
-		credBuilder.WriteString(m.From)
-		credBuilder.WriteString(credentials[0])
-		credBuilder.WriteString(c.device.SecretKey)
-		temp := sha256.Sum256([]byte(credBuilder.String()))
-		origin := base64.StdEncoding.EncodeToString(temp[:])
-		if origin != credentials[1] {
-			log.Warningf("Incorrect signature %s != %s in session %d", origin, credentials[1], c.sessionID)
-			c.device.ID = 0
-			c.device.Name = ""
+		if err := c.checkCert(c.device.Name); err != nil {
+			c.resetDevice()
+			return err
+		}
+		serverSignature, err := auth.Verify(&c.device, m.From+credentials[0], credentials[1])
+		if err != nil {
+			log.Warningf("Client %d incorrect proof in session %d %v", id, c.sessionID, err)
+			c.resetDevice()
 			return Errorf(InvalidCredentials, "Client %d initialize fail session %d", id, c.sessionID)
 		}
-		if er := connection.AddClientToCache(c.device.ID, c); er == nil {
-			c.readChan <- dto.Message{
-				Command: dto.InitByIDCOMMAND,
-				Jmp:     m.Jmp,
-				Proto:   m.Proto,
-				From:    "0",
-				To:      m.From,
-				Content: []byte(answerInitByIDOk),
-			}
-			log.Infof("Client %d init by id ok", c.device.ID)
-			return nil
+		if er := c.addToCache(); er != nil {
+			log.Error(er.Error())
+			c.resetDevice()
+			return er
+		}
+		c.queue.Put(dto.Message{
+			Command: dto.InitByIDCOMMAND,
+			Jmp:     m.Jmp,
+			Proto:   m.Proto,
+			From:    "0",
+			To:      m.From,
+			Content: []byte(c.withResumeToken(answerInitByIDOk + ";" + serverSignature)),
+		})
+		c.restoreTopics()
+		if len(connection.GetSessions(c.device.ID)) == 1 { // Остальные сессии клиента уже в сети
+			c.notifyPresence(presenceOnline)
 		}
-		log.Infof("Credentials is equals TODO destroy old session with client %s id: %d", c.device.Name, c.device.ID)
-		er := fmt.Errorf("Client %d can not create in session %d", id, c.sessionID)
-		log.Error(er.Error())
-		return er
+		log.Infof("Client %d init by id ok", c.device.ID)
+		return nil
 	}
-	c.device.ID = 0
-	c.device.Name = ""
+	c.resetDevice()
 	return Errorf(BadCommandError, "Incorrect ID in session %d", c.sessionID)
 }
 
-// For init by name you need send name (m.From), (salt ; signature)-(m.Content) signature - base64(SHA256(name + salt + base64(SHA256(name+password))))
+// For init by name you need request nonce with empty content at first, answer is (nonce ; salt ; iterations).
+// Than send name (m.From), (nonce ; proof)-(m.Content) proof - SCRAM-SHA-256 ClientProof for AuthMessage (name + nonce), secret is base64(SHA256(name+password))
+// Answer is (INIT OK ; ServerSignature) or (INIT OK ; ServerSignature ; resume token) if ResumeTimeOut is set
 func (c *C2cDevice) initByName(m *dto.Message) error {
-	credentials := strings.Split(string(m.Content), ";") // Разделим соль от подписи
+	if len(m.Content) == 0 { // Клиент запрашивает nonce для подписи
+		id, err := c.storage.GetClientID(m.From)
+		if err != nil {
+			log.Warning(err.Error())
+			return NewC2cError(ClientNotFindError, err.Error())
+		}
+		device, err := c.storage.GetClient(id)
+		if err != nil {
+			log.Warning(err.Error())
+			return NewC2cError(ClientNotFindError, err.Error())
+		}
+		if c.device.ID == 0 && c.certLogin(device.Name) {
+			c.setDevice(*device)
+			return c.initByCert(m, answerInitByNameOk)
+		}
+		return c.sendNonce(m, auth.Challenge(device))
+	}
+	credentials := strings.Split(string(m.Content), ";") // Разделим nonce от подписи
 	if len(credentials) < 2 {
 		err := Errorf(InvalidCredentials, "Client %s undefined signature for initialize in session %d", m.From, c.sessionID)
 		log.Warning(err.Error())
 		return err
 	}
-	if CheckSaltByUserName(m.From, credentials[0]) > saltUniqCount {
-		err := Errorf(InvalidCredentials, "Client %s salt already been used %d times", m.From, saltUniqCount)
+	if !c.checkNonce(credentials[0]) {
+		err := Errorf(InvalidCredentials, "Client %s nonce is incorrect or expired in session %d", m.From, c.sessionID)
 		log.Warning(err.Error())
 		return err
 	}
@@ -189,57 +241,56 @@ func (c *C2cDevice) initByName(m *dto.Message) error {
 			log.Warning(err.Error())
 			return NewC2cError(ClientNotFindError, err.Error())
 		}
-		c.device = *device
+		c.setDevice(*device)
 	}
 	if c.device.Name == m.From {
-		var cred strings.Builder
-		cred.WriteString(m.From)
-		cred.WriteString(credentials[0])
-		cred.WriteString(c.device.SecretKey)
-		temp := sha256.Sum256([]byte(cred.String()))
-		origin := base64.StdEncoding.EncodeToString(temp[:])
-		if origin != credentials[1] {
-			log.Errorf("Origin credentials: %s", cred.String())
-			log.Errorf("SHA256: %x", temp)
-			log.Errorf("Incorrect signature %s != %s in session %d", origin, credentials[1], c.sessionID)
-			c.device.ID = 0
-			c.device.Name = ""
+		if err := c.checkCert(c.device.Name); err != nil {
+			c.resetDevice()
+			return err
+		}
+		serverSignature, err := auth.Verify(&c.device, m.From+credentials[0], credentials[1])
+		if err != nil {
+			log.Errorf("Client %s incorrect proof in session %d %v", m.From, c.sessionID, err)
+			c.resetDevice()
 			return Errorf(InvalidCredentials, "client %s finded and initialize fail in session %d", m.From, c.sessionID)
 		}
-		if er := connection.AddClientToCache(c.device.ID, c); er != nil {
-			log.Warning(er.Error())
-			log.Infof("Credentials is equals TODO destroy old session with client %s id: %x", c.device.Name, c.device.ID)
-			er = fmt.Errorf("Can not create abonent in session %d", c.sessionID)
+		if er := c.addToCache(); er != nil {
 			log.Error(er.Error())
-			c.device.ID = 0
-			c.device.Name = ""
+			c.resetDevice()
 			return er
 		}
-		c.readChan <- dto.Message{
+		c.queue.Put(dto.Message{
 			Command: dto.InitByNameCOMMAND,
 			Jmp:     m.Jmp,
 			Proto:   m.Proto,
 			From:    "0",
 			To:      m.From,
-			Content: []byte(answerInitByNameOk),
+			Content: []byte(c.withResumeToken(answerInitByNameOk + ";" + serverSignature)),
+		})
+		c.restoreTopics()
+		if len(connection.GetSessions(c.device.ID)) == 1 { // Остальные сессии клиента уже в сети
+			c.notifyPresence(presenceOnline)
 		}
 		log.Infof("Client %s init by name ok", c.device.Name)
 		return nil
 	}
-	c.device.ID = 0
-	c.device.Name = ""
+	c.resetDevice()
 	err := Errorf(BadCommandError, "Incorrect name in session %d", c.sessionID)
 	log.Warning(err.Error())
 	return err
 }
 
-// For registration new device you need send an unique name, and base64(sha256(name+password))
+// For registration new device you need send an unique name, and verifier (salt ; iterations ; StoredKey ; ServerKey)
+// or secret base64(sha256(name+password)), than server calculates verifier itself
 func (c *C2cDevice) registerNewDevice(m *dto.Message) error {
 	if c.device.ID != 0 {
 		err := Errorf(BadCommandError, "Client %x already exist error in session %d", c.device.ID, c.sessionID)
 		log.Warning(err.Error())
 		return err
 	}
+	if err := c.checkCert(m.From); err != nil {
+		return err
+	}
 	dev, err := c.storage.GenerateClient(c.clientType, m.From, string(m.Content))
 	if err != nil {
 		log.Warning(err.Error())
@@ -249,18 +300,22 @@ func (c *C2cDevice) registerNewDevice(m *dto.Message) error {
 		log.Warning(err.Error())
 		return Errorf(InternalError, "Can not save new client with name %s in session %d", m.From, c.sessionID)
 	}
-	c.device = *dev
+	c.setDevice(*dev)
 	thisID := strconv.FormatUint(dev.ID, 16)
-	c.readChan <- dto.Message{
+	c.queue.Put(dto.Message{
 		Command: dto.RegisterCOMMAND,
 		Jmp:     m.Jmp,
 		Proto:   m.Proto,
 		From:    "0",
 		To:      m.From,
 		Content: []byte(thisID),
-	}
+	})
 	log.Infof("Registered new client %s with ID %x", c.device.Name, c.device.ID)
-	return connection.AddClientToCache(dev.ID, c)
+	if err = connection.AddClientToCache(dev.ID, c); err != nil {
+		return err
+	}
+	c.notifyPresence(presenceOnline)
+	return nil
 }
 
 // generateNewDevice - генерирует имя и  идентификатор для указанного в m.Content пароля минимум три символа
@@ -270,21 +325,28 @@ func (c *C2cDevice) generateNewDevice(m *dto.Message) error {
 		log.Warning(err.Error())
 		return err
 	}
+	if certAuth() == certAuthBoth {
+		return NewC2cError(UnsupportedCommandError, "Generate new device is disabled, certificate is required")
+	}
 	if dev, err := c.storage.GenerateRandomClient(c.clientType, string(m.Content)); err == nil {
 		if err = c.storage.SaveClient(dev); err != nil {
 			log.Warning(err.Error())
 			return Errorf(InternalError, "Can not save new client with name %s in session %d", m.From, c.sessionID)
 		}
-		c.device = *dev
-		c.readChan <- dto.Message{
+		c.setDevice(*dev)
+		c.queue.Put(dto.Message{
 			Command: dto.GenerateCOMMAND,
 			Jmp:     m.Jmp,
 			Proto:   m.Proto,
 			From:    "0",
 			To:      c.device.Name,
-		}
+		})
 		log.Infof("Generate new client %s with ID %x", c.device.Name, c.device.ID)
-		return connection.AddClientToCache(c.device.ID, c)
+		if err = connection.AddClientToCache(c.device.ID, c); err != nil {
+			return err
+		}
+		c.notifyPresence(presenceOnline)
+		return nil
 	}
 	return Errorf(InternalError, "Can not generate new client in session %d", c.sessionID)
 }
@@ -301,21 +363,37 @@ func (c *C2cDevice) findID(arg string) uint64 {
 }
 
 func (c *C2cDevice) sendNewMessage(msg *dto.Message) error {
+	if _, ok := parseRemote(msg.To); ok { // Адрес клиента соседнего сервера
+		c.listenerMtx.RLock()
+		defer c.listenerMtx.RUnlock()
+		if c.putRemote(*msg, matchRemote(msg.To)) == 0 {
+			return Errorf(ClientNotFindError, "Remote client %s is not connected in session %d", msg.To, c.sessionID)
+		}
+		return nil
+	}
 	toID := c.findID(msg.To)
 	c.listenerMtx.RLock()
 	defer c.listenerMtx.RUnlock()
+	if toID == 0 && len(msg.To) != 0 && msg.To != "0" && peers.forward(c, msg) {
+		return nil // Имя адресата не известно на этом сервере
+	}
 	if toID == 0 {
-		for id, ch := range c.listenerList {
-			if ch != nil {
-				msg.To = strconv.FormatUint(id, 16)
-				*ch <- *msg
+		for id, list := range c.listenerList {
+			msg.To = strconv.FormatUint(id, 16)
+			for _, q := range list {
+				q.Put(*msg)
 			}
 		}
+		c.putRemote(*msg, anyRemote)
 	} else {
-		if val, ok := c.listenerList[toID]; ok {
-			if val != nil {
-				*val <- *msg
+		if list, ok := c.listenerList[toID]; ok {
+			for _, q := range list { // Сообщение получают все сессии адресата
+				q.Put(*msg)
 			}
+		} else if c.putRemote(*msg, matchRemote(msg.To)) != 0 {
+			return nil // Адресат подключен через соседний сервер
+		} else if _, err := c.storage.GetClient(toID); err != nil && peers.forward(c, msg) {
+			return nil // Адресат не зарегистрирован на этом сервере
 		} else {
 			return Errorf(ClientNotFindError, "Client with ID %x undefined in session %d", toID, c.sessionID)
 		}
@@ -336,34 +414,53 @@ func (c *C2cDevice) destroyConnection(msg *dto.Message) error {
 			return err
 		}
 	}
+	if _, ok := parseRemote(msg.To); ok { // Соединение с клиентом соседнего сервера
+		match := matchRemote(msg.To)
+		c.listenerMtx.Lock()
+		cnt := c.putRemote(*msg, match)
+		c.dropRemote(match)
+		c.listenerMtx.Unlock()
+		if cnt == 0 {
+			return Errorf(ClientNotFindError, "Undefined client %s when try destroy session whith %s", msg.To, c.device.Name)
+		}
+		return nil
+	}
 	toID := c.findID(msg.To)
 	if toID == 0 { // disconnect from all connected devices
 		log.Infof("Close all connection for client %s: %x in session %d", c.device.Name, c.device.ID, c.sessionID)
 		c.listenerMtx.Lock()
-		for id, ch := range c.listenerList {
-			if ch != nil {
-				to := strconv.FormatUint(id, 16)
-				msg.To = to
-				*ch <- *msg                // Передаем сообщение об отключении себя от них
-				delete(c.listenerList, id) // Удаляем у себя подписанные устройства
+		for id, list := range c.listenerList {
+			msg.To = strconv.FormatUint(id, 16)
+			for _, q := range list {
+				q.Put(*msg) // Передаем сообщение об отключении себя от них
 			}
+			delete(c.listenerList, id) // Удаляем у себя подписанные устройства
 		}
+		c.putRemote(*msg, anyRemote)
+		c.dropRemote(anyRemote)
 		c.listenerMtx.Unlock()
-		connection.DelClientFromCashe(c.device.ID)  // Удаляем в подписанных устройствах себя
-		connection.AddClientToCache(c.device.ID, c) // Заново добавляем себя в кеш
+		connection.DisconnectAll(c.device.ID, c) // Удаляем в подписанных устройствах эту сессию
 		return nil
 	}
 	c.listenerMtx.Lock()
-	ch, ok := c.listenerList[toID]
+	list, ok := c.listenerList[toID]
 	if !ok {
+		match := matchRemote(msg.To)
+		cnt := c.putRemote(*msg, match) // Клиент подключен через соседний сервер
+		c.dropRemote(match)
 		c.listenerMtx.Unlock()
-		return Errorf(ClientNotFindError, "Undefined client %s when try destroy session whith %s", msg.To, c.device.Name)
+		if cnt == 0 {
+			return Errorf(ClientNotFindError, "Undefined client %s when try destroy session whith %s", msg.To, c.device.Name)
+		}
+		return nil
 	}
 	log.Tracef("Destroy connection with on client %x in session %d", toID, c.sessionID)
-	*ch <- *msg                  // Send destroy connection message to the remote device
+	for _, q := range list {
+		q.Put(*msg) // Send destroy connection message to the remote device
+	}
 	delete(c.listenerList, toID) // Удаляем у себя подписанное устройство
 	c.listenerMtx.Unlock()
-	connection.DisconnectClient(c.device.ID, toID) // Удялем в подписанных устройствах себя
+	connection.DisconnectClient(c.device.ID, c, toID) // Удялем в подписанных устройствах эту сессию
 	return nil
 }
 
@@ -373,16 +470,18 @@ func (c *C2cDevice) destroyConnection(msg *dto.Message) error {
 // В качестве параметром "Кого" (msg.Content[0].Data) и "Кому" (msg.Content[1].Data) не может быть обобщенных данных. Все должно быть конкретно!!!
 func (c *C2cDevice) setProperies(msg *dto.Message) error {
 	toID := c.findID(msg.To)
-	if toID == 0 {
+	if _, ok := parseRemote(msg.To); toID == 0 && !ok {
 		err := NewC2cError(BadCommandError, "To client must be specified")
 		log.Warning(err.Error())
 		return err
 	}
 	c.listenerMtx.RLock()
-	if ch, ok := c.listenerList[toID]; ok {
-		if ch != nil {
-			*ch <- *msg
+	if list, ok := c.listenerList[toID]; ok {
+		for _, q := range list {
+			q.Put(*msg)
 		}
+	} else {
+		c.putRemote(*msg, matchRemote(msg.To))
 	}
 	c.listenerMtx.RUnlock()
 	return nil
@@ -0,0 +1,220 @@
+package c2cService
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Продолжение сессии после разрыва соединения.
+// Если задан ResumeTimeOut, ответ на инициализацию содержит токен последним параметром (INIT OK;подпись;токен).
+// После разрыва соединения сессия клиента остается в сети ResumeTimeOut секунд: соединения с другими клиентами
+// и подписки сохраняются, а пришедшие сообщения остаются в ее очереди.
+// ResumeCOMMAND - From идентификатор или имя клиента, Content токен. Ответ RESUME OK;новый токен,
+// после него клиент получает все сообщения из очереди
+
+const answerResumeOk = "RESUME OK"
+
+const resumeTokenSize = 16 // Размер токена в байтах
+
+// parkedSession - сессия отключившегося клиента, которая ждет продолжения
+type parkedSession struct {
+	dev   *C2cDevice
+	stop  chan struct{}
+	timer *time.Timer
+}
+
+type resumeList struct {
+	list map[string]*parkedSession // Ожидающие продолжения сессии по токену
+	mtx  sync.Mutex
+}
+
+var resumes = resumeList{list: make(map[string]*parkedSession)}
+
+func resumeTimeOut() time.Duration {
+	return time.Duration(cf.Get().ResumeTimeOut) * time.Second
+}
+
+func (r *resumeList) add(token string, val *parkedSession) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.list[token] = val
+}
+
+func (r *resumeList) get(token string) *parkedSession {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.list[token]
+}
+
+// take - удаляет и возвращает сессию, вернет nil если ее уже нет
+func (r *resumeList) take(token string, val *parkedSession) *parkedSession {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	res, ok := r.list[token]
+	if !ok || (val != nil && res != val) {
+		return nil
+	}
+	delete(r.list, token)
+	return res
+}
+
+// takeClient - удаляет и возвращает все ожидающие продолжения сессии клиента id
+func (r *resumeList) takeClient(id uint64) []*parkedSession {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var res []*parkedSession
+	for token, p := range r.list {
+		if p.dev.GetID() == id { // Сессия может закрываться в это время по таймеру
+			res = append(res, p)
+			delete(r.list, token)
+		}
+	}
+	return res
+}
+
+// takeSession - удаляет и возвращает ожидающую продолжения сессию sessionID, вернет nil если ее нет
+func (r *resumeList) takeSession(sessionID uint32) *parkedSession {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for token, p := range r.list {
+		if p.dev.sessionID == sessionID {
+			delete(r.list, token)
+			return p
+		}
+	}
+	return nil
+}
+
+// takeAll - удаляет и возвращает все ожидающие продолжения сессии
+func (r *resumeList) takeAll() []*parkedSession {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	res := make([]*parkedSession, 0, len(r.list))
+	for token, p := range r.list {
+		res = append(res, p)
+		delete(r.list, token)
+	}
+	return res
+}
+
+// watch - закрывает сессию, если ее очередь закрылась при переполнении, пока клиент не на связи
+func (p *parkedSession) watch(token string) {
+	select {
+	case <-p.dev.queue.Done():
+		if resumes.take(token, p) != nil {
+			p.release()
+			log.Infof("Queue of client %s is closed while waiting for resume", p.dev.device.Name)
+			p.dev.shutdown()
+		}
+	case <-p.stop:
+	}
+}
+
+// release - останавливает ожидание продолжения сессии
+func (p *parkedSession) release() {
+	p.timer.Stop()
+	close(p.stop)
+}
+
+// withResumeToken - добавляет к ответу на инициализацию новый токен для продолжения сессии
+func (c *C2cDevice) withResumeToken(answer string) string {
+	c.resumeToken = ""
+	if resumeTimeOut() == 0 {
+		return answer
+	}
+	buf := make([]byte, resumeTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		log.Errorf("Can not generate resume token in session %d %v", c.sessionID, err)
+		return answer
+	}
+	c.resumeToken = hex.EncodeToString(buf)
+	return answer + ";" + c.resumeToken
+}
+
+// park - оставляет сессию в сети после разрыва соединения. Вернет false если сессию продолжить нельзя
+func (c *C2cDevice) park() bool {
+	if isStopping() || c.device.ID == 0 || len(c.resumeToken) == 0 || len(c.peer) != 0 {
+		return false
+	}
+	select {
+	case <-c.queue.Done(): // Сессия закрыта сервером
+		return false
+	default:
+	}
+	p := &parkedSession{
+		dev:  c,
+		stop: make(chan struct{}),
+	}
+	token := c.resumeToken
+	p.timer = time.AfterFunc(resumeTimeOut(), func() {
+		if resumes.take(token, p) != nil {
+			p.release()
+			log.Infof("Client %s did not resume session %d", c.device.Name, c.sessionID)
+			c.shutdown()
+		}
+	})
+	resumes.add(token, p)
+	go p.watch(token)
+	log.Infof("Session %d of client %s is waiting for resume", c.sessionID, c.device.Name)
+	return true
+}
+
+// dropParked - закрывает ожидающие продолжения сессии клиента, который вошел заново
+func (c *C2cDevice) dropParked() {
+	for _, p := range resumes.takeClient(c.device.ID) {
+		p.release()
+		log.Infof("Client %s logged in again, close waiting session %d", c.device.Name, p.dev.sessionID)
+		p.dev.shutdown()
+	}
+}
+
+// resume - продолжение сессии после разрыва соединения. m.From - идентификатор или имя клиента, Content - токен
+func (c *C2cDevice) resume(m *dto.Message) error {
+	if c.device.ID != 0 {
+		return Errorf(BadCommandError, "Client %x already initialized in session %d", c.device.ID, c.sessionID)
+	}
+	token := string(m.Content)
+	p := resumes.get(token)
+	var id uint64
+	var name string
+	if p != nil {
+		id, name, _ = p.dev.identity() // Сессия может закрываться в это время по таймеру
+	}
+	if p == nil || (!strings.EqualFold(name, m.From) && c.findID(m.From) != id) {
+		err := Errorf(InvalidCredentials, "Client %s resume token is incorrect or expired in session %d", m.From, c.sessionID)
+		log.Warning(err.Error())
+		return err
+	}
+	if err := c.checkCert(name); err != nil { // Токен не заменяет сертификат в режиме both
+		return err
+	}
+	if resumes.take(token, p) == nil {
+		return Errorf(InvalidCredentials, "Client %s resume token is expired in session %d", m.From, c.sessionID)
+	}
+	old := p.dev
+	c.setDevice(old.device)
+	c.queue.Put(dto.Message{
+		Command: dto.ResumeCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.From,
+		Content: []byte(c.withResumeToken(answerResumeOk)),
+	})
+	p.release()
+	cnt := old.queue.MoveTo(c.queue) // Сообщения, пришедшие пока клиента не было
+	if err := connection.ReplaceSession(c.device.ID, old, c); err != nil {
+		log.Error(err.Error())
+	}
+	old.moveTo(c)
+	old.queue.Close()
+	log.Infof("Client %s resumed session %d in session %d, %d messages delivered", c.device.Name, old.sessionID, c.sessionID, cnt)
+	return nil
+}
@@ -0,0 +1,107 @@
+package c2cService
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Остановка сервера.
+// Все клиенты получают ShutdownCOMMAND (From - "0", Content - SHUTDOWN или SHUTDOWN;адрес из ShutdownRedirect,
+// к которому следует переподключиться), после чего соединение закрывается.
+// Сообщения, пришедшие до уведомления, клиент получает перед ним, а недоставленные сообщения
+// SaveDataCOMMAND и PropertiesCOMMAND сохраняются в базе. Сессии, ожидающие продолжения, закрываются сразу
+
+const answerShutdown = "SHUTDOWN"
+
+type deviceList struct {
+	list map[*C2cDevice]struct{} // Все открытые сессии
+	mtx  sync.Mutex
+}
+
+var devices = deviceList{list: make(map[*C2cDevice]struct{})}
+
+var stopping int32 // Не 0 после начала остановки сервера
+
+func isStopping() bool {
+	return atomic.LoadInt32(&stopping) != 0
+}
+
+func (d *deviceList) add(c *C2cDevice) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.list[c] = struct{}{}
+}
+
+func (d *deviceList) del(c *C2cDevice) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.list, c)
+}
+
+func (d *deviceList) all() []*C2cDevice {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	res := make([]*C2cDevice, 0, len(d.list))
+	for c := range d.list {
+		res = append(res, c)
+	}
+	return res
+}
+
+// Shutdown - уведомляет всех клиентов об остановке сервера и завершает их сессии.
+// Вызывается после закрытия всех слушателей, сами соединения закрываются асинхронно
+func Shutdown() {
+	atomic.StoreInt32(&stopping, 1)
+	stopPeers()
+	for _, p := range resumes.takeAll() {
+		p.release()
+		p.dev.shutdown()
+	}
+	content := answerShutdown
+	if len(cf.Get().ShutdownRedirect) != 0 {
+		content += ";" + cf.Get().ShutdownRedirect
+	}
+	list := devices.all()
+	for _, c := range list {
+		id, _, peer := c.identity()
+		if len(peer) != 0 { // Соседний сервер просто отключаем
+			c.queue.Close()
+			continue
+		}
+		c.queue.Force(dto.Message{
+			Command: dto.ShutdownCOMMAND,
+			Jmp:     1,
+			Proto:   1,
+			From:    "0",
+			To:      strconv.FormatUint(id, 16),
+			Content: []byte(content),
+		})
+	}
+	log.Infof("Server is stopping, %d sessions notified", len(list))
+}
+
+// saveUndelivered - сохраняет в базе оставшиеся в закрытой очереди сообщения SaveDataCOMMAND и PropertiesCOMMAND
+func (c *C2cDevice) saveUndelivered() {
+	if c.device.ID == 0 {
+		return
+	}
+	cnt := 0
+	for m, ok := c.queue.Get(); ok; m, ok = c.queue.Get() {
+		if len(m.Content) == 0 || (m.Command != dto.SaveDataCOMMAND && m.Command != dto.PropertiesCOMMAND) {
+			continue
+		}
+		if _, err := c.storage.Add(c.device.ID, dto.UnSendedMsg{Proto: m.Proto, Command: m.Command, From: m.From, Content: m.Content}); err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		cnt++
+	}
+	if cnt != 0 {
+		log.Infof("%d undelivered messages to %s are saved", cnt, c.device.Name)
+	}
+}
@@ -0,0 +1,237 @@
+package c2cService
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blabu/egeonC2cService/client"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Топики - именованные комнаты, сообщения в которые получают все подписчики.
+// SubscribeCOMMAND - To имя топика, Content PERSIST если подписку надо восстанавливать при следующей инициализации
+// UnsubscribeCOMMAND - To имя топика, постоянная подписка тоже удаляется
+// PublishCOMMAND - To имя топика, сообщение получат все подписчики кроме отправившей его сессии, From - идентификатор отправителя
+// Подписка принадлежит сессии клиента, постоянные подписки восстанавливаются в каждой новой сессии.
+// Одна сессия может быть подписана не больше чем на MaxSubscriptions топиков
+// Топики presence: зарезервированы для уведомлений о клиентах (см. presence.go)
+
+const topicPersist = "PERSIST"
+const answerSubscribeOk = "SUBSCRIBE OK"
+const answerUnsubscribeOk = "UNSUBSCRIBE OK"
+
+const maxTopicNameSize = 128
+
+type topicList struct {
+	list map[string]map[*client.Queue]uint64 // Идентификаторы клиентов по очередям сессий подписчиков топика
+	mtx  sync.RWMutex
+}
+
+var topics = topicList{list: make(map[string]map[*client.Queue]uint64)}
+
+// subscribe - подписывает сессию на топик. Вернет false если сессия уже подписана на limit других топиков, 0 - без ограничений
+func (t *topicList) subscribe(topic string, id uint64, q *client.Queue, limit int) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	subscribers, ok := t.list[topic]
+	if _, found := subscribers[q]; found {
+		return true
+	}
+	if limit > 0 {
+		cnt := 0
+		for _, val := range t.list {
+			if _, found := val[q]; found {
+				cnt++
+			}
+		}
+		if cnt >= limit {
+			return false
+		}
+	}
+	if !ok {
+		subscribers = make(map[*client.Queue]uint64)
+		t.list[topic] = subscribers
+	}
+	subscribers[q] = id
+	return true
+}
+
+func maxSubscriptions() int {
+	if cf.Get().MaxSubscriptions == 0 {
+		return cf.DefaultMaxSubscriptions
+	}
+	return int(cf.Get().MaxSubscriptions)
+}
+
+// unsubscribe - вернет false если сессия не была подписана на топик
+func (t *topicList) unsubscribe(topic string, q *client.Queue) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	subscribers, ok := t.list[topic]
+	if !ok {
+		return false
+	}
+	if _, ok = subscribers[q]; !ok {
+		return false
+	}
+	delete(subscribers, q)
+	if len(subscribers) == 0 {
+		delete(t.list, topic)
+	}
+	return true
+}
+
+// leaveAll - удаляет сессию из всех топиков, постоянные подписки в базе сохраняются
+func (t *topicList) leaveAll(q *client.Queue) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for topic, subscribers := range t.list {
+		delete(subscribers, q)
+		if len(subscribers) == 0 {
+			delete(t.list, topic)
+		}
+	}
+}
+
+// replace - подписки сессии old теперь получает очередь q
+func (t *topicList) replace(old, q *client.Queue) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for _, subscribers := range t.list {
+		if id, ok := subscribers[old]; ok {
+			delete(subscribers, old)
+			subscribers[q] = id
+		}
+	}
+}
+
+// publish - передает сообщение всем подписчикам кроме сессии отправителя, вернет количество получателей.
+// Если задан allow, сообщение получат только подписчики, для идентификатора которых allow вернет true.
+// allow может читать базу, поэтому вызывается уже без блокировки списка топиков
+func (t *topicList) publish(from *client.Queue, m dto.Message, allow func(id uint64) bool) int {
+	t.mtx.RLock()
+	subscribers := make(map[*client.Queue]uint64, len(t.list[m.To]))
+	for q, id := range t.list[m.To] {
+		if q != from {
+			subscribers[q] = id
+		}
+	}
+	t.mtx.RUnlock()
+	cnt := 0
+	for q, id := range subscribers {
+		if allow == nil || allow(id) {
+			q.Put(m)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (c *C2cDevice) checkTopic(m *dto.Message) error {
+	if c.device.ID == 0 {
+		return NewC2cError(BadCommandError, "Initialize device at first")
+	}
+	if len(m.To) == 0 || len(m.To) > maxTopicNameSize {
+		return Errorf(BadCommandError, "Incorrect topic name size %d in session %d", len(m.To), c.sessionID)
+	}
+	return nil
+}
+
+func (c *C2cDevice) subscribe(m *dto.Message) error {
+	if err := c.checkTopic(m); err != nil {
+		return err
+	}
+	if isPresenceTopic(m.To) {
+		if err := c.presenceTarget(m); err != nil {
+			return err
+		}
+	}
+	if !topics.subscribe(m.To, c.device.ID, c.queue, maxSubscriptions()) {
+		return Errorf(AccessDeniedError, "Client %x can not subscribe to more than %d topics", c.device.ID, maxSubscriptions())
+	}
+	if string(m.Content) == topicPersist {
+		saved, _ := c.storage.GetTopics(c.device.ID)
+		if indexOf(saved, m.To) < 0 {
+			if err := c.storage.SetTopics(c.device.ID, append(saved, m.To)); err != nil {
+				log.Error(err.Error())
+				return Errorf(InternalError, "Can not save topic %s for client %x", m.To, c.device.ID)
+			}
+		}
+	}
+	c.queue.Put(dto.Message{
+		Command: dto.SubscribeCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.To,
+		Content: []byte(answerSubscribeOk),
+	})
+	log.Infof("Client %x subscribed to topic %s", c.device.ID, m.To)
+	return nil
+}
+
+func (c *C2cDevice) unsubscribe(m *dto.Message) error {
+	if err := c.checkTopic(m); err != nil {
+		return err
+	}
+	if isPresenceTopic(m.To) {
+		if id := c.findID(strings.TrimPrefix(m.To, presenceTopicPrefix)); id != 0 {
+			m.To = presenceTopic(id)
+		}
+	}
+	found := topics.unsubscribe(m.To, c.queue)
+	saved, _ := c.storage.GetTopics(c.device.ID)
+	if i := indexOf(saved, m.To); i >= 0 {
+		found = true
+		if err := c.storage.SetTopics(c.device.ID, append(saved[:i], saved[i+1:]...)); err != nil {
+			log.Error(err.Error())
+			return Errorf(InternalError, "Can not delete topic %s for client %x", m.To, c.device.ID)
+		}
+	}
+	if !found {
+		return Errorf(ClientNotFindError, "Client is not subscribed to topic %s", m.To)
+	}
+	c.queue.Put(dto.Message{
+		Command: dto.UnsubscribeCOMMAND,
+		Jmp:     m.Jmp,
+		Proto:   m.Proto,
+		From:    "0",
+		To:      m.To,
+		Content: []byte(answerUnsubscribeOk),
+	})
+	log.Infof("Client %x unsubscribed from topic %s", c.device.ID, m.To)
+	return nil
+}
+
+func (c *C2cDevice) publish(m *dto.Message) error {
+	if err := c.checkTopic(m); err != nil {
+		return err
+	}
+	if isPresenceTopic(m.To) {
+		return Errorf(AccessDeniedError, "Topic %s is reserved for server", m.To)
+	}
+	msg := *m
+	msg.From = strconv.FormatUint(c.device.ID, 16) // Подписчики должны знать настоящего отправителя
+	cnt := topics.publish(c.queue, msg, nil)
+	log.Tracef("Message from %x published to %d subscribers of topic %s", c.device.ID, cnt, m.To)
+	return nil
+}
+
+// restoreTopics - восстанавливает постоянные подписки после инициализации клиента
+func (c *C2cDevice) restoreTopics() {
+	saved, err := c.storage.GetTopics(c.device.ID)
+	if err != nil {
+		return
+	}
+	for _, topic := range saved {
+		if isPresenceTopic(topic) && !c.canWatch(topic) {
+			log.Infof("Client %x can not watch %s anymore, subscription is not restored", c.device.ID, topic)
+			continue
+		}
+		topics.subscribe(topic, c.device.ID, c.queue, 0) // Постоянные подписки уже прошли ограничение при сохранении
+	}
+	log.Infof("Client %x subscriptions restored %v", c.device.ID, saved)
+}
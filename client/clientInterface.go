@@ -9,6 +9,7 @@ package client
 import (
 	"context"
 	"io"
+	"strconv"
 
 	"github.com/blabu/egeonC2cService/dto"
 )
@@ -16,9 +17,9 @@ import (
 //ListenerInterface - интерфейс, который позволяет реализовать систему подписки
 // на рассылку от устройства устройству
 type ListenerInterface interface {
-	AddListener(from uint64, ch *chan dto.Message)
-	DelListener(from uint64)
-	GetListenerChan() *chan dto.Message
+	AddListener(from uint64, q *Queue)
+	DelListener(from uint64, q *Queue) // q == nil - удалить все очереди клиента from
+	GetQueue() *Queue
 }
 
 //ReadWriteCloser - создает интерфейс работы с клиентом
@@ -36,6 +37,32 @@ type ReadWriteCloser interface {
 	io.Closer
 }
 
+// ClientError - ошибка бизнес логики, о которой можно сообщить клиенту ответным сообщением
+type ClientError interface {
+	error
+	// Code - тип ошибки, передается клиенту
+	Code() uint16
+	// IsCritical - true если после такой ошибки соединение с клиентом надо разорвать
+	IsCritical() bool
+}
+
+// ErrorMessage - формирует ответ ErrorCOMMAND на сообщение m.
+// Content: код ошибки (число в шестнадцатиричном представлении);текст ошибки
+func ErrorMessage(m *dto.Message, code uint16, text string) dto.Message {
+	content := make([]byte, 0, 5+len(text))
+	content = strconv.AppendUint(content, uint64(code), 16)
+	content = append(content, ';')
+	content = append(content, text...)
+	return dto.Message{
+		Command: dto.ErrorCOMMAND,
+		Proto:   m.Proto,
+		Jmp:     m.Jmp,
+		From:    "0",
+		To:      m.From,
+		Content: content,
+	}
+}
+
 // CachedClientInterface - агрегация клиентского интерфейса
 type CachedClientInterface interface {
 	ListenerInterface
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/dto"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// Политики переполнения очереди сообщений к клиенту
+const (
+	OverflowDropOldest = "drop-oldest" // Отбросить самое старое сообщение в очереди (по умолчанию)
+	OverflowDropNewest = "drop-newest" // Отбросить новое сообщение
+	OverflowSpill      = "spill"       // Сохранить новое сообщение в базе для отправки позже
+	OverflowDisconnect = "disconnect"  // Закрыть очередь, медленный клиент будет отключен
+)
+
+// Queue - ограниченная очередь сообщений к клиенту. Запись в очередь никогда не блокирует отправителя,
+// а запись в закрытую очередь просто отбрасывает сообщение.
+// Кроме общей длины ограничено количество сообщений от одного отправителя (m.From), чтобы один отправитель
+// не вытеснял сообщения остальных. Превышение любого ограничения обрабатывается политикой переполнения
+type Queue struct {
+	list     []dto.Message
+	size     int
+	linkSize int            // Максимальное количество сообщений от одного отправителя
+	senders  map[string]int // Количество сообщений в очереди по отправителям
+	overflow string
+	spill    func(m dto.Message) bool // Сохраняет сообщение, которое не поместилось в очередь
+	ready    chan struct{}            // Сигнал о новых сообщениях в очереди
+	done     chan struct{}            // Закрывается вместе с очередью
+	closed   bool
+	mtx      sync.Mutex
+}
+
+// NewQueue - создает очередь длиной size, в которой от одного отправителя не больше linkSize сообщений,
+// с политикой переполнения overflow. linkSize <= 0 - ограничена только длина очереди.
+// spill нужен только для политики OverflowSpill, вернет false если сообщение сохранить нельзя
+func NewQueue(size int, linkSize int, overflow string, spill func(m dto.Message) bool) *Queue {
+	if size <= 0 {
+		size = configuration.DefaultMaxQueuePacketSize
+	}
+	if linkSize <= 0 || linkSize > size {
+		linkSize = size
+	}
+	return &Queue{
+		list:     make([]dto.Message, 0, 16),
+		size:     size,
+		linkSize: linkSize,
+		senders:  make(map[string]int),
+		overflow: overflow,
+		spill:    spill,
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Put - добавляет сообщение в очередь. Вернет false если сообщение в очередь не попало
+func (q *Queue) Put(m dto.Message) bool {
+	res, spill := q.put(m)
+	if !spill {
+		return res
+	}
+	// Очередь переполнена, сообщение сохраняется в базе уже без блокировки очереди
+	if q.spill != nil && q.spill(m) {
+		return true
+	}
+	log.Warningf("Queue to %s is full, message from %s can not be saved and dropped", m.To, m.From)
+	return false
+}
+
+// put - добавляет сообщение с учетом политики переполнения. spill - true если сообщение надо сохранить в базе
+func (q *Queue) put(m dto.Message) (res bool, spill bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return false, false
+	}
+	link := q.senders[m.From] >= q.linkSize // Отправитель занял всю свою часть очереди
+	if link || len(q.list) >= q.size {
+		switch q.overflow {
+		case OverflowDropNewest:
+			log.Warningf("Queue to %s is full, message from %s dropped", m.To, m.From)
+			return false, false
+		case OverflowSpill:
+			return false, true
+		case OverflowDisconnect:
+			log.Warningf("Queue to %s is full, slow client will be disconnected", m.To)
+			q.close()
+			return false, false
+		default:
+			i := 0
+			if link { // Вытесняется самое старое сообщение этого же отправителя
+				for i < len(q.list) && q.list[i].From != m.From {
+					i++
+				}
+			}
+			log.Warningf("Queue to %s is full, message from %s dropped", q.list[i].To, q.list[i].From)
+			q.remove(i)
+		}
+	}
+	q.list = append(q.list, m)
+	q.senders[m.From]++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true, false
+}
+
+// Force - добавляет служебное сообщение в очередь без учета ее длины. Вернет false если очередь закрыта
+func (q *Queue) Force(m dto.Message) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return false
+	}
+	q.list = append(q.list, m)
+	q.senders[m.From]++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Get - забирает первое сообщение из очереди, вернет false если очередь пуста
+func (q *Queue) Get() (dto.Message, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.list) == 0 {
+		return dto.Message{}, false
+	}
+	m := q.list[0]
+	q.list[0] = dto.Message{}
+	q.list = q.list[1:]
+	q.delSender(m.From)
+	return m, true
+}
+
+// remove - удаляет из очереди сообщение с индексом i
+func (q *Queue) remove(i int) {
+	q.delSender(q.list[i].From)
+	copy(q.list[i:], q.list[i+1:])
+	q.list[len(q.list)-1] = dto.Message{}
+	q.list = q.list[:len(q.list)-1]
+}
+
+func (q *Queue) delSender(from string) {
+	if q.senders[from] <= 1 {
+		delete(q.senders, from)
+	} else {
+		q.senders[from]--
+	}
+}
+
+// Ready - сигнал о том, что в очереди появились сообщения
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Done - закрывается, когда очередь закрыта
+func (q *Queue) Done() <-chan struct{} {
+	return q.done
+}
+
+// Close - закрывает очередь, дальнейшие сообщения отбрасываются
+func (q *Queue) Close() {
+	q.mtx.Lock()
+	q.close()
+	q.mtx.Unlock()
+}
+
+func (q *Queue) close() {
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+// MoveTo - переносит все сообщения этой очереди в конец очереди to, вернет количество перенесенных сообщений.
+// Перенесенные сообщения уже прошли ограничение длины и переполнением очереди to не считаются.
+// Если очередь to уже закрыта, сообщения сохраняются через ее spill, а те, что сохранить нельзя, остаются в этой очереди
+func (q *Queue) MoveTo(to *Queue) int {
+	q.mtx.Lock()
+	list := q.list
+	q.list = make([]dto.Message, 0, 16)
+	q.senders = make(map[string]int)
+	q.mtx.Unlock()
+	if len(list) == 0 {
+		return 0
+	}
+	to.mtx.Lock()
+	if !to.closed {
+		to.list = append(to.list, list...)
+		for _, m := range list {
+			to.senders[m.From]++
+		}
+		select {
+		case to.ready <- struct{}{}:
+		default:
+		}
+		to.mtx.Unlock()
+		return len(list)
+	}
+	to.mtx.Unlock()
+	rest := make([]dto.Message, 0, len(list))
+	for _, m := range list {
+		if to.spill == nil || !to.spill(m) {
+			rest = append(rest, m)
+		}
+	}
+	q.mtx.Lock()
+	q.list = append(rest, q.list...)
+	for _, m := range rest {
+		q.senders[m.From]++
+	}
+	q.mtx.Unlock()
+	return 0
+}
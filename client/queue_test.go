@@ -0,0 +1,84 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
+
+func contents(q *Queue) string {
+	res := ""
+	for m, ok := q.Get(); ok; m, ok = q.Get() {
+		res += string(m.Content)
+	}
+	return res
+}
+
+func TestQueueLinkSize(t *testing.T) {
+	cases := []struct {
+		overflow string
+		expected string
+	}{
+		{OverflowDropOldest, "a2b1a3"},
+		{OverflowDropNewest, "a1a2b1"},
+		{OverflowSpill, "a1a2b1"},
+	}
+	for _, c := range cases {
+		var spilled []dto.Message
+		q := NewQueue(4, 2, c.overflow, func(m dto.Message) bool {
+			spilled = append(spilled, m)
+			return true
+		})
+		q.Put(dto.Message{From: "a", Content: []byte("a1")})
+		q.Put(dto.Message{From: "a", Content: []byte("a2")})
+		q.Put(dto.Message{From: "b", Content: []byte("b1")})
+		q.Put(dto.Message{From: "a", Content: []byte("a3")}) // Очередь не полна, но a занял свою часть
+		if res := contents(q); res != c.expected {
+			t.Errorf("%s: queue contains %s, expected %s", c.overflow, res, c.expected)
+		}
+		if c.overflow == OverflowSpill && (len(spilled) != 1 || string(spilled[0].Content) != "a3") {
+			t.Errorf("%s: spilled %v", c.overflow, spilled)
+		}
+		if len(q.senders) != 0 {
+			t.Errorf("%s: senders are not counted correctly %v", c.overflow, q.senders)
+		}
+	}
+}
+
+func TestQueueLinkDisconnect(t *testing.T) {
+	q := NewQueue(4, 1, OverflowDisconnect, nil)
+	q.Put(dto.Message{From: "a"})
+	if q.Put(dto.Message{From: "a"}) {
+		t.Error("Message over the sender limit is put")
+	}
+	select {
+	case <-q.Done():
+	default:
+		t.Error("Queue of slow client is not closed")
+	}
+}
+
+func TestQueueMoveToClosed(t *testing.T) {
+	q := NewQueue(4, 0, OverflowDropOldest, nil)
+	q.Put(dto.Message{From: "a", Content: []byte("a1")})
+	q.Put(dto.Message{From: "b", Content: []byte("b1")})
+	to := NewQueue(4, 0, OverflowDropOldest, func(m dto.Message) bool {
+		return m.From == "a" // Сообщение b сохранить нельзя
+	})
+	to.Close()
+	if cnt := q.MoveTo(to); cnt != 0 {
+		t.Errorf("%d messages moved to closed queue", cnt)
+	}
+	if res := contents(q); res != "b1" {
+		t.Errorf("Not saved messages are lost, queue contains %q", res)
+	}
+	q.Put(dto.Message{From: "a", Content: []byte("a2")})
+	open := NewQueue(1, 0, OverflowDropOldest, nil)
+	open.Put(dto.Message{From: "c", Content: []byte("c1")})
+	if cnt := q.MoveTo(open); cnt != 1 {
+		t.Errorf("%d messages moved, expected 1", cnt)
+	}
+	if res := contents(open); res != "c1a2" {
+		t.Errorf("Queue contains %q after move", res)
+	}
+}
@@ -2,7 +2,6 @@ package savemsgservice
 
 import (
 	"context"
-	"fmt"
 	"strconv"
 
 	"github.com/blabu/egeonC2cService/client"
@@ -32,13 +31,14 @@ func (s *saveMsgClient) SaveMsgFilter(msg *dto.Message) bool {
 
 // Write - пытаемся отправить сообщение клиенту.
 // Если не получается, но клиент существует,
-// а сообщение не пустое и важное (узнаем по команде), сохранием его в базе
+// а сообщение не пустое и важное (узнаем по команде), сохранием его в базе.
+// Если клиент не найден возвращаем исходную ошибку клиентской логики
 func (s *saveMsgClient) Write(msg *dto.Message) error {
 	err := s.client.Write(msg)
 	if err != nil && s.SaveMsgFilter(msg) { // Если
-		toID, er := strconv.ParseUint(msg.To, 10, 64)
+		toID, er := strconv.ParseUint(msg.To, 16, 64)
 		if er != nil {
-			toID, err = s.db.GetClientID(msg.To)
+			toID, _ = s.db.GetClientID(msg.To)
 		}
 		if toID != 0 {
 			id, e := s.db.Add(toID, dto.UnSendedMsg{
@@ -54,7 +54,7 @@ func (s *saveMsgClient) Write(msg *dto.Message) error {
 			log.Infof("Message %d from %s to %x is saved", msg.ID, msg.From, toID)
 			return nil
 		}
-		return fmt.Errorf("Undefine client ID in %s", msg.To)
+		log.Warningf("Undefine client ID in %s", msg.To)
 	}
 	return err
 }
@@ -63,7 +63,7 @@ func (s *saveMsgClient) Read(ctx context.Context, handler dto.ClientReadHandler)
 	s.client.Read(ctx,
 		func(msg dto.Message, err error) error {
 			clientError := handler(msg, err)
-			if clientError == nil {
+			if clientError == nil && msg.Command != dto.ShutdownCOMMAND { // После уведомления об остановке сервера клиенту больше ничего не отправляем
 				userID := s.client.GetID()
 				if userID > 0 {
 					for m, e := s.db.GetNext(userID); e == nil; m, e = s.db.GetNext(userID) {
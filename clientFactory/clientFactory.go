@@ -10,9 +10,9 @@ import (
 )
 
 //CreateClientLogic - create client for c2c or s2s communication
-func CreateClientLogic(p parser.Parser, sessionID uint32) client.ReadWriteCloser {
-	m := cf.Config.MaxQueuePacketSize
+func CreateClientLogic(p parser.Parser, sessionID uint32, remoteAddr string, certNames []string) client.ReadWriteCloser {
+	m := cf.Get().MaxQueuePacketSize
 	db := c2cData.GetBoltDbInstance()
-	client := c2cService.NewC2cDevice(db, sessionID, m)
+	client := c2cService.NewC2cDevice(db, sessionID, m, remoteAddr, certNames)
 	return savemsgservice.NewDecorator(db, client)
 }
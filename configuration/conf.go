@@ -9,37 +9,146 @@ import (
 
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sync/atomic"
 )
 
-// Config - глобальная структура описывающая конфигурационный файл
+// Config - глобальная структура описывающая конфигурационный файл.
+// Незаданные настройки получают значения по умолчанию (см. setDefaults),
+// каждую настройку можно переопределить переменной окружения (см. EnvPrefix)
 type ConfigFile struct {
-	ServerTCPPort      string `yaml:"ServerTCPPort"`      // TCP адресс для получения данных
-	ServerTLSPort      string `yaml:"ServerTLSPort"`      // TLS адресс для получения данных. Для него также обязательным является абсолютный путь до сертификата и приватного ключа
-	CertificatePath    string `yaml:"CertificatePath"`    //Путь к сертификату для TLS сессии
-	PrivateKeyPath     string `yaml:"PrivateKeyPath"`     // Путь к приватному ключу для сертиификата для TLS сессии
-	MaxQueuePacketSize uint32 `yaml:"MaxQueuePacketSize"` // Максимальная длина очереди сообщений к одному клиенту
-	SessionTimeOut     uint32 `yaml:"SessionTimeOut"`     // Таймоут сессии, Если от клиента в течении этого времени в секундах не приходят запросы, Клиент отключается
-	MaxPacketSize      uint16 `yaml:"MaxPacketSize"`      // Максимальный размер принимаемого сообщения в Kb за один раз (один пакет)
-	C2cStore           string `yaml:"C2cStore"`           // Путь к базе данных клиентов, при отсутствии будет создана новая
-	LogPath            string `yaml:"LogPath"`            // Путь куда сохранять логи
-	ClientType         uint16 `yaml:"ClientType"`         // Тип клиента должен быть больше 0
-	SaveDuration       uint16 `yaml:"SaveDuration"`       // Промежуток времени для сохранения логов
-	MaxPeerConnection  uint16 `yaml:"MaxPeerConnection"`  // Максимальное количество подключенных к одному пиру клиентов
-}
-
-//Config - глобальная структура со всеми конфигурациями сервера
-var Config ConfigFile
+	ServerTCPPort       string            `yaml:"ServerTCPPort"`       // TCP адресс для получения данных
+	ServerTLSPort       string            `yaml:"ServerTLSPort"`       // TLS адресс для получения данных. Для него также обязательным является абсолютный путь до сертификата и приватного ключа
+	CertificatePath     string            `yaml:"CertificatePath"`     //Путь к сертификату для TLS сессии
+	PrivateKeyPath      string            `yaml:"PrivateKeyPath"`      // Путь к приватному ключу для сертиификата для TLS сессии
+	ServerWSPort        string            `yaml:"ServerWSPort"`        // WebSocket адресс для получения данных (протокол тот же, что и для TCP)
+	WSPath              string            `yaml:"WSPath"`              // Путь по которому принимаются WebSocket соединения, по умолчанию "/"
+	WSUseTLS            bool              `yaml:"WSUseTLS"`            // Принимать WebSocket соединения по TLS (wss) с сертификатом из CertificatePath
+	WSAllowedOrigins    []string          `yaml:"WSAllowedOrigins"`    // Страницы (scheme://host[:port]), с которых разрешены WebSocket соединения, "*" - с любых. Пустой - только с того же хоста
+	ClientCAPath        string            `yaml:"ClientCAPath"`        // Путь к сертификатам центров сертификации (PEM) для проверки сертификатов TLS и WSS клиентов, пустой - сертификаты клиентов не запрашиваются
+	ClientCertRequired  bool              `yaml:"ClientCertRequired"`  // Разрывать TLS соединения клиентов без действительного сертификата
+	ClientCertName      string            `yaml:"ClientCertName"`      // Где в сертификате имя клиента: cn (по умолчанию), san или any
+	ClientCertAuth      string            `yaml:"ClientCertAuth"`      // cert - сертификат заменяет пароль (по умолчанию), both - нужен и сертификат и пароль
+	MaxQueuePacketSize  uint32            `yaml:"MaxQueuePacketSize"`  // Максимальная длина очереди сообщений к одному клиенту
+	MaxLinkPacketSize   uint32            `yaml:"MaxLinkPacketSize"`   // Максимальное количество сообщений от одного отправителя в очереди к клиенту, по умолчанию четверть MaxQueuePacketSize
+	SessionTimeOut      uint32            `yaml:"SessionTimeOut"`      // Таймоут сессии, Если от клиента в течении этого времени в секундах не приходят запросы, Клиент отключается
+	MaxPacketSize       uint16            `yaml:"MaxPacketSize"`       // Максимальный размер принимаемого сообщения в Kb за один раз (один пакет)
+	C2cStore            string            `yaml:"C2cStore"`            // Путь к базе данных клиентов, при отсутствии будет создана новая
+	LogPath             string            `yaml:"LogPath"`             // Путь куда сохранять логи
+	ClientType          uint16            `yaml:"ClientType"`          // Тип новых клиентов, 0 - регистрация новых клиентов запрещена
+	SaveDuration        uint16            `yaml:"SaveDuration"`        // Промежуток времени для сохранения логов
+	MaxPeerConnection   uint16            `yaml:"MaxPeerConnection"`   // Максимальное количество подключенных к одному пиру клиентов
+	MaxClientErrors     uint16            `yaml:"MaxClientErrors"`     // Количество ошибочных запросов клиента за минуту, после которого соединение разрывается
+	MaxSubscriptions    uint16            `yaml:"MaxSubscriptions"`    // Максимальное количество топиков, на которые подписана одна сессия клиента
+	ServerName          string            `yaml:"ServerName"`          // Имя сервера в федерации, должно быть уникальным
+	PeerServers         []string          `yaml:"PeerServers"`         // TCP адреса соседних серверов федерации
+	PeerSecret          string            `yaml:"PeerSecret"`          // Общий секрет для авторизации серверов федерации
+	PeerTimeout         uint32            `yaml:"PeerTimeout"`         // Время ожидания ответа от соседних серверов в секундах
+	NonceTimeOut        uint32            `yaml:"NonceTimeOut"`        // Время в секундах, в течении которого клиент должен подписать выданный ему nonce
+	ScramIterations     uint32            `yaml:"ScramIterations"`     // Количество итераций PBKDF2 при сохранении ключей новых клиентов
+	DenyConnectDefault  bool              `yaml:"DenyConnectDefault"`  // Запрещать подключение к клиентам, для которых не заданы правила доступа
+	ApproveTimeOut      uint32            `yaml:"ApproveTimeOut"`      // Время в секундах, в течении которого клиент должен подтвердить запрос на соединение
+	LoginPolicy         string            `yaml:"LoginPolicy"`         // Что делать при повторном входе клиента, который уже в сети: reject, kick или multiple
+	LoginPolicies       map[uint16]string `yaml:"LoginPolicies"`       // Политика повторного входа для отдельных типов клиентов
+	ResumeTimeOut       uint32            `yaml:"ResumeTimeOut"`       // Время в секундах, в течении которого отключившийся клиент может продолжить сессию. 0 - не ждать
+	QueueOverflow       string            `yaml:"QueueOverflow"`       // Что делать при переполнении очереди к клиенту: drop-oldest, drop-newest, spill или disconnect
+	WriteTimeOut        uint32            `yaml:"WriteTimeOut"`        // Минимальное время на запись в соединение в миллисекундах
+	WriteTimeOutPerKb   uint32            `yaml:"WriteTimeOutPerKb"`   // Дополнительное время на запись каждого килобайта в миллисекундах
+	SlowConsumerLatency uint32            `yaml:"SlowConsumerLatency"` // Если запись длится дольше этого времени в миллисекундах, клиент не успевает читать
+	SlowConsumerTime    uint32            `yaml:"SlowConsumerTime"`    // Время в секундах, которое клиент может не успевать читать до отключения
+	ShutdownTimeOut     uint32            `yaml:"ShutdownTimeOut"`     // Время в секундах, в течении которого при остановке сервера ожидается завершение всех сессий
+	ShutdownRedirect    string            `yaml:"ShutdownRedirect"`    // Адрес сервера, к которому клиентам следует переподключиться при остановке этого сервера
+	AdminPort           string            `yaml:"AdminPort"`           // HTTP адрес для администрирования сервера, пустой - не запускать
+	AdminToken          string            `yaml:"AdminToken"`          // Токен для доступа к администрированию (заголовок Authorization: Bearer)
+	MetricsPort         string            `yaml:"MetricsPort"`         // HTTP адрес для метрик (/metrics) и проверок состояния (/healthz, /readyz), пустой - не запускать
+	ProxyProtocol       []string          `yaml:"ProxyProtocol"`       // Слушатели за балансировщиком с PROXY протоколом v1/v2: tcp, tls, ws
+	ProxyTrusted        []string          `yaml:"ProxyTrusted"`        // Адреса или подсети балансировщиков, которым разрешено передавать адрес клиента
+}
 
-func ReadConfig(filePath string) error {
+// restartOnly - настройки, которые применяются только при запуске сервера и не перечитываются
+var restartOnly = map[string]bool{
+	"ServerTCPPort": true, "ServerTLSPort": true, "ServerWSPort": true, "WSPath": true, "WSUseTLS": true,
+	"C2cStore": true, "ServerName": true, "PeerSecret": true,
+	"AdminPort": true, "MetricsPort": true, "ProxyProtocol": true, "ProxyTrusted": true,
+}
+
+var config atomic.Value // *ConfigFile - текущая конфигурация сервера
+
+func init() {
+	config.Store(new(ConfigFile))
+}
+
+//Get - вернет текущую конфигурацию сервера. Возвращаемая структура никогда не изменяется,
+//при перечитывании файла конфигурации она подменяется целиком
+func Get() *ConfigFile {
+	return config.Load().(*ConfigFile)
+}
+
+// parseFile - читает файл конфигурации, применяет переменные окружения и значения по умолчанию
+func parseFile(filePath string) (*ConfigFile, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	res := new(ConfigFile)
+	if err = yaml.Unmarshal(data, res); err != nil {
+		return nil, err
+	}
+	if err = applyEnv(res); err != nil {
+		return nil, err
+	}
+	setDefaults(res)
+	return res, nil
+}
+
+// readFile - читает и проверяет файл конфигурации
+func readFile(filePath string) (*ConfigFile, error) {
+	res, err := parseFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = res.Validate(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//ReadConfig - читает файл конфигурации при запуске сервера
+func ReadConfig(filePath string) error {
+	res, err := readFile(filePath)
 	if err != nil {
 		return err
 	}
-	err = yaml.Unmarshal(data, &Config)
-	return err
+	config.Store(res)
+	return nil
+}
+
+//Reload - перечитывает файл конфигурации на ходу. changed - имена примененных настроек,
+//ignored - имена измененных настроек, которые применяются только при запуске сервера, они остаются прежними
+func Reload(filePath string) (changed []string, ignored []string, err error) {
+	res, err := readFile(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	newVal := reflect.ValueOf(res).Elem()
+	oldVal := reflect.ValueOf(Get()).Elem()
+	for i := 0; i < newVal.NumField(); i++ {
+		if reflect.DeepEqual(newVal.Field(i).Interface(), oldVal.Field(i).Interface()) {
+			continue
+		}
+		name := newVal.Type().Field(i).Name
+		if restartOnly[name] {
+			newVal.Field(i).Set(oldVal.Field(i))
+			ignored = append(ignored, name)
+		} else {
+			changed = append(changed, name)
+		}
+	}
+	config.Store(res)
+	return changed, ignored, nil
 }
@@ -0,0 +1,291 @@
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/blabu/egeonC2cService/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix - префикс переменных окружения, которые переопределяют настройки из файла.
+// Имя переменной - имя настройки в верхнем регистре через подчеркивание: ServerTCPPort - C2C_SERVER_TCP_PORT.
+// Списки задаются через запятую (C2C_PROXY_PROTOCOL=tcp,ws), LoginPolicies в формате YAML (C2C_LOGIN_POLICIES={4096: kick})
+const EnvPrefix = "C2C_"
+
+const hiddenValue = "******" // Так выводятся секреты при проверке конфигурации
+
+// Значения по умолчанию для незаданных числовых настроек.
+// Пакеты, которые читают эти настройки до загрузки конфигурации, берут значения отсюда же
+const (
+	DefaultMaxQueuePacketSize  = 256  // Длина очереди сообщений к клиенту
+	DefaultSessionTimeOut      = 300  // 5 минут
+	DefaultMaxPacketSize       = 1024 // 1 Мб
+	DefaultSaveDuration        = 24   // Новый файл логов раз в сутки
+	DefaultMaxPeerConnection   = 8
+	DefaultMaxClientErrors     = 10
+	DefaultMaxSubscriptions    = 100
+	DefaultPeerTimeout         = 10   // Секунд
+	DefaultNonceTimeOut        = 30   // Секунд
+	DefaultApproveTimeOut      = 30   // Секунд
+	DefaultWriteTimeOut        = 5000 // Миллисекунд
+	DefaultWriteTimeOutPerKb   = 100  // Миллисекунд
+	DefaultSlowConsumerLatency = 1000 // Миллисекунд
+	DefaultSlowConsumerTime    = 30   // Секунд
+	DefaultShutdownTimeOut     = 10   // Секунд
+)
+
+// setDefaults - значения по умолчанию для незаданных настроек.
+// Настройки, для которых ноль что-то означает (ClientType 0 - регистрация запрещена, ResumeTimeOut 0 - не ждать,
+// пустые AdminPort и MetricsPort - не запускать), остаются как есть
+func setDefaults(c *ConfigFile) {
+	setString(&c.ServerTCPPort, ":3555")
+	setString(&c.WSPath, "/")
+	setUint32(&c.MaxQueuePacketSize, DefaultMaxQueuePacketSize)
+	setUint32(&c.MaxLinkPacketSize, c.MaxQueuePacketSize/4)
+	setUint32(&c.SessionTimeOut, DefaultSessionTimeOut)
+	setUint16(&c.MaxPacketSize, DefaultMaxPacketSize)
+	setString(&c.C2cStore, "./c2c.db")
+	setString(&c.LogPath, "./")
+	setUint16(&c.SaveDuration, DefaultSaveDuration)
+	setUint16(&c.MaxPeerConnection, DefaultMaxPeerConnection)
+	setUint16(&c.MaxClientErrors, DefaultMaxClientErrors)
+	setUint16(&c.MaxSubscriptions, DefaultMaxSubscriptions)
+	setUint32(&c.PeerTimeout, DefaultPeerTimeout)
+	setUint32(&c.NonceTimeOut, DefaultNonceTimeOut)
+	setUint32(&c.ScramIterations, auth.DefaultIterations)
+	setUint32(&c.ApproveTimeOut, DefaultApproveTimeOut)
+	setString(&c.LoginPolicy, "reject")
+	setString(&c.QueueOverflow, "drop-oldest")
+	setUint32(&c.WriteTimeOut, DefaultWriteTimeOut)
+	setUint32(&c.WriteTimeOutPerKb, DefaultWriteTimeOutPerKb)
+	setUint32(&c.SlowConsumerLatency, DefaultSlowConsumerLatency)
+	setUint32(&c.SlowConsumerTime, DefaultSlowConsumerTime)
+	setUint32(&c.ShutdownTimeOut, DefaultShutdownTimeOut)
+	setString(&c.ClientCertName, "cn")
+	setString(&c.ClientCertAuth, "cert")
+}
+
+func setString(val *string, def string) {
+	if len(*val) == 0 {
+		*val = def
+	}
+}
+
+func setUint32(val *uint32, def uint32) {
+	if *val == 0 {
+		*val = def
+	}
+}
+
+func setUint16(val *uint16, def uint16) {
+	if *val == 0 {
+		*val = def
+	}
+}
+
+// envName - имя переменной окружения для настройки name: WSUseTLS - C2C_WS_USE_TLS
+func envName(name string) string {
+	var res strings.Builder
+	res.WriteString(EnvPrefix)
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if !unicode.IsUpper(prev) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				res.WriteRune('_')
+			}
+		}
+		res.WriteRune(unicode.ToUpper(r))
+	}
+	return res.String()
+}
+
+// applyEnv - переопределяет настройки значениями из переменных окружения
+func applyEnv(c *ConfigFile) error {
+	val := reflect.ValueOf(c).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		name := envName(val.Type().Field(i).Name)
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		field := val.Field(i)
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(env)
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(env); err == nil {
+				field.SetBool(b)
+			}
+		case reflect.Uint16, reflect.Uint32:
+			var u uint64
+			if u, err = strconv.ParseUint(env, 10, field.Type().Bits()); err == nil {
+				field.SetUint(u)
+			}
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(env, ",") {
+				if item = strings.TrimSpace(item); len(item) != 0 {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		default:
+			res := reflect.New(field.Type())
+			if err = yaml.Unmarshal([]byte(env), res.Interface()); err == nil {
+				field.Set(res.Elem())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Incorrect value of environment variable %s %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate - проверяет настройки, вернет ошибку со списком всех неверных значений
+func (c *ConfigFile) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	addresses := make(map[string]string)
+	checkAddr := func(name, addr string) {
+		if len(addr) == 0 {
+			return
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil {
+			add("%s has incorrect address %q", name, addr)
+			return
+		}
+		if other, ok := addresses[addr]; ok {
+			add("%s and %s use the same address %s", other, name, addr)
+		}
+		addresses[addr] = name
+	}
+	checkAddr("ServerTCPPort", c.ServerTCPPort)
+	checkAddr("ServerTLSPort", c.ServerTLSPort)
+	checkAddr("ServerWSPort", c.ServerWSPort)
+	checkAddr("AdminPort", c.AdminPort)
+	checkAddr("MetricsPort", c.MetricsPort)
+	if len(c.ServerTCPPort) == 0 {
+		add("ServerTCPPort is required")
+	}
+	if len(c.ServerTLSPort) != 0 || (len(c.ServerWSPort) != 0 && c.WSUseTLS) {
+		if len(c.CertificatePath) == 0 || len(c.PrivateKeyPath) == 0 {
+			add("CertificatePath and PrivateKeyPath are required for TLS")
+		}
+	}
+	if err := checkDir(c.LogPath); err != nil {
+		add("LogPath %s is not a writable directory %v", c.LogPath, err)
+	}
+	if !strings.HasPrefix(c.WSPath, "/") {
+		add("WSPath must start with /")
+	}
+	for _, val := range c.WSAllowedOrigins {
+		if u, err := url.Parse(val); val != "*" && (err != nil || len(u.Scheme) == 0 || len(u.Host) == 0) {
+			add("WSAllowedOrigins has incorrect origin %s, expected scheme://host[:port]", val)
+		}
+	}
+	if !oneOf(c.ClientCertName, "cn", "san", "any") {
+		add("ClientCertName must be cn, san or any")
+	}
+	if !oneOf(c.ClientCertAuth, "cert", "both") {
+		add("ClientCertAuth must be cert or both")
+	}
+	if !oneOf(c.LoginPolicy, "reject", "kick", "multiple") {
+		add("LoginPolicy must be reject, kick or multiple")
+	}
+	for clientType, policy := range c.LoginPolicies {
+		if !oneOf(policy, "reject", "kick", "multiple") {
+			add("LoginPolicies for client type %d must be reject, kick or multiple", clientType)
+		}
+	}
+	if c.QueueOverflow != "drop-oldest" && c.QueueOverflow != "drop-newest" && c.QueueOverflow != "spill" && c.QueueOverflow != "disconnect" {
+		add("QueueOverflow must be drop-oldest, drop-newest, spill or disconnect")
+	}
+	for _, val := range c.ProxyProtocol {
+		if !oneOf(val, "tcp", "tls", "ws") {
+			add("ProxyProtocol has unknown listener %s, expected tcp, tls or ws", val)
+		}
+	}
+	for _, val := range c.ProxyTrusted {
+		if _, _, err := net.ParseCIDR(val); err != nil && net.ParseIP(val) == nil {
+			add("ProxyTrusted has incorrect address %s", val)
+		}
+	}
+	if len(c.PeerServers) != 0 && (len(c.ServerName) == 0 || len(c.PeerSecret) == 0) {
+		add("ServerName and PeerSecret are required for PeerServers")
+	}
+	for _, val := range c.PeerServers {
+		if _, _, err := net.SplitHostPort(val); err != nil {
+			add("PeerServers has incorrect address %s", val)
+		}
+	}
+	if len(c.AdminPort) != 0 && len(c.AdminToken) == 0 {
+		add("AdminToken is required for AdminPort %s", c.AdminPort)
+	}
+	if len(problems) != 0 {
+		return errors.New("Incorrect configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkDir - проверяет, что в папке можно создавать файлы
+func checkDir(dir string) error {
+	f, err := ioutil.TempFile(dir, ".check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func oneOf(val string, list ...string) bool {
+	for _, v := range list {
+		if strings.EqualFold(val, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check - читает и проверяет файл конфигурации, выводит в w итоговые настройки с учетом переменных окружения
+// и значений по умолчанию. Секреты не выводятся
+func Check(filePath string, w io.Writer) error {
+	res, err := parseFile(filePath)
+	if err != nil {
+		return err
+	}
+	out := *res
+	if len(out.PeerSecret) != 0 {
+		out.PeerSecret = hiddenValue
+	}
+	if len(out.AdminToken) != 0 {
+		out.AdminToken = hiddenValue
+	}
+	data, err := yaml.Marshal(&out)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	return res.Validate()
+}
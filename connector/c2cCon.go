@@ -3,32 +3,20 @@ package connector
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
-	"math/rand"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/blabu/egeonC2cService/auth"
 	"github.com/blabu/egeonC2cService/dto"
 	"github.com/blabu/egeonC2cService/parser"
 )
 
 const proto = 1
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-func randStringRunes(n int) string {
-	b := make([]rune, n)
-	rand.Seed(time.Now().UnixNano())
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-	return string(b)
-}
-
 //ConfConnection - конфигурация соединения
 type ConfConnection struct {
 	User        string
@@ -40,11 +28,11 @@ type ConfConnection struct {
 
 //Connection - структура реализующая интерфейс IConnection
 type Connection struct {
-	conn        net.Conn
-	cnf         ConfConnection
-	p           parser.Parser
-	stop        chan bool
-	receiveBuff []byte
+	conn   net.Conn
+	cnf    ConfConnection
+	p      parser.Parser
+	stop   chan bool
+	reader *bufio.Reader // Хранит принятые, но еще не прочитанные данные между вызовами Read
 }
 
 //IConnection - интерфейс работы с соединением
@@ -58,11 +46,11 @@ type IConnection interface {
 func NewC2cConnection(conn net.Conn, cnf ConfConnection) (IConnection, error) {
 	p := parser.CreateEmptyParser(cnf.СhunkSize)
 	res := &Connection{
-		conn:        conn,
-		cnf:         cnf,
-		p:           p,
-		stop:        make(chan bool),
-		receiveBuff: make([]byte, p.GetMinimumDataSize(), cnf.СhunkSize),
+		conn:   conn,
+		cnf:    cnf,
+		p:      p,
+		stop:   make(chan bool),
+		reader: bufio.NewReader(conn),
 	}
 	if cnf.IsNew {
 		err := res.register()
@@ -106,37 +94,19 @@ func (c *Connection) Write(to string, command uint16, data []byte) error {
 }
 
 func (c *Connection) Read() (from string, command uint16, data []byte) {
-	reader := bufio.NewReader(c.conn)
-	n, err := reader.Read(c.receiveBuff)
-	if err != nil {
-		return "", 0, nil
-	}
-	c.receiveBuff = c.receiveBuff[:n]
-	restSize, err := c.p.IsFullReceiveMsg(c.receiveBuff)
-	if err != nil {
-		return "", 0, nil
-	}
-	if restSize != 0 {
-		resp := make([]byte, restSize)
-		c.conn.SetReadDeadline(time.Now().Add(time.Duration(restSize) * 10 * time.Millisecond))
-		_, err := io.ReadFull(reader, resp)
-		if err != nil {
-			return "", 0, nil
-		}
-		c.receiveBuff = append(c.receiveBuff, resp...)
-	}
-	m, err := c.p.ParseMessage(c.receiveBuff)
+	m, err := c.p.ReadMessage(c.reader)
 	if err != nil {
 		return "", 0, nil
 	}
-	c.receiveBuff = c.receiveBuff[:c.p.GetMinimumDataSize()]
 	return m.From, m.Command, m.Content
 }
 
 func (c *Connection) register() error {
-	sign := sha256.Sum256([]byte(c.cnf.User + c.cnf.Pass))
-	signature := base64.StdEncoding.EncodeToString(sign[:])
-	if err := c.Write("0", dto.RegisterCOMMAND, []byte(signature)); err != nil {
+	verifier, err := auth.Verifier(auth.Secret(c.cnf.User, c.cnf.Pass), auth.DefaultIterations)
+	if err != nil {
+		return err
+	}
+	if err := c.Write("0", dto.RegisterCOMMAND, []byte(verifier)); err != nil {
 		return err
 	}
 	_, cmd, data := c.Read()
@@ -147,19 +117,33 @@ func (c *Connection) register() error {
 }
 
 func (c *Connection) init() error {
-	temp := sha256.Sum256([]byte(c.cnf.User + c.cnf.Pass))
-	credentials := base64.StdEncoding.EncodeToString(temp[:])
-	salt := randStringRunes(32)
-	resSign := sha256.Sum256([]byte(c.cnf.User + salt + credentials))
-	signature := base64.StdEncoding.EncodeToString(resSign[:])
-	if err := c.Write("0", dto.InitByNameCOMMAND, []byte(salt+";"+signature)); err != nil {
+	if err := c.Write("0", dto.InitByNameCOMMAND, nil); err != nil { // Запрашиваем nonce для подписи
+		return err
+	}
+	_, cmd, challenge := c.Read()
+	if len(challenge) == 0 || cmd != dto.InitByNameCOMMAND {
+		return errors.New("Can not init. Nonce is not received")
+	}
+	if _, ok := c.conn.(*tls.Conn); ok && bytes.HasPrefix(challenge, []byte("INIT OK;")) {
+		return nil // Сервер принял сертификат клиента вместо пароля, сам сервер проверен по его сертификату
+	}
+	params := strings.SplitN(string(challenge), ";", 2)
+	if len(params) < 2 {
+		return fmt.Errorf("Bad init challenge %s", challenge)
+	}
+	proof, serverSignature, err := auth.ClientProof(auth.Secret(c.cnf.User, c.cnf.Pass), params[1], c.cnf.User+params[0])
+	if err != nil {
+		return err
+	}
+	if err := c.Write("0", dto.InitByNameCOMMAND, []byte(params[0]+";"+proof)); err != nil {
 		return err
 	}
 	_, cmd, data := c.Read()
 	if data == nil || cmd != dto.InitByNameCOMMAND {
 		return errors.New("Can not init. Errors while read")
 	}
-	if bytes.Index(data, []byte("INIT OK")) < 0 {
+	answer := []byte("INIT OK;" + serverSignature)
+	if !bytes.Equal(data, answer) && !bytes.HasPrefix(data, append(answer, ';')) { // Дальше может быть токен продолжения сессии
 		return fmt.Errorf("Bad init %s", data)
 	}
 	return nil
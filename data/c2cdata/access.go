@@ -0,0 +1,39 @@
+package c2cdata
+
+import (
+	"encoding/json"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type AccessImpl struct {
+	accessStorage *bolt.DB
+}
+
+//GetAccess - список правил доступа к клиенту ID. Вернет ошибку если правила для клиента не заданы
+func (a *AccessImpl) GetAccess(ID uint64) ([]string, error) {
+	var rules []string
+	err := view([]byte(Access), a.accessStorage, func(buck *bolt.Bucket) error {
+		value := buck.Get(uint64ToBytes(ID))
+		if value == nil {
+			return errors.New("Access rules are undefined")
+		}
+		return json.Unmarshal(value, &rules)
+	})
+	return rules, err
+}
+
+//SetAccess - сохраняет правила доступа к клиенту ID. Пустой список удаляет правила
+func (a *AccessImpl) SetAccess(ID uint64, rules []string) error {
+	return update([]byte(Access), a.accessStorage, func(buck *bolt.Bucket) error {
+		if len(rules) == 0 {
+			return buck.Delete(uint64ToBytes(ID))
+		}
+		value, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		return buck.Put(uint64ToBytes(ID), value)
+	})
+}
@@ -5,4 +5,6 @@ const (
 	Clients     = "clients"     // Непосредственно сами клиенты с ключем по ID
 	UnsededMsg  = "unsended"    // Не отправленные сообщения для каждого пользователя
 	MaxClientID = "maxClientID" // Максимально выданный в системе идентификатор
+	Access      = "access"      // Правила доступа к клиенту с ключем по ID
+	Topics      = "topics"      // Постоянные подписки клиента на топики с ключем по ID
 )
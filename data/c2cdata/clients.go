@@ -25,9 +25,25 @@ func (d *ClientImpl) delClient(id []byte) error {
 			if e2 != nil {
 				return e2
 			}
-			if err := Names.Delete(id); err != nil {
+			value := Clients.Get(id)
+			if value == nil {
+				return fmt.Errorf("Undefined client with id %d", bytesToUint64(id))
+			}
+			if err := Names.Delete([]byte(deserialize(value).Name)); err != nil {
 				return err
 			}
+			for _, name := range []string{Access, Topics} {
+				if buck := tx.Bucket([]byte(name)); buck != nil {
+					if err := buck.Delete(id); err != nil {
+						return err
+					}
+				}
+			}
+			if tx.Bucket(id) != nil { // Не доставленные клиенту сообщения
+				if err := tx.DeleteBucket(id); err != nil {
+					return err
+				}
+			}
 			return Clients.Delete(id)
 		})
 }
@@ -91,6 +107,26 @@ func (d *ClientImpl) DelClient(ID uint64) error {
 	return d.delClient(uint64ToBytes(ID))
 }
 
+//SetLastSeen - сохраняет время и адрес последнего подключения клиента
+func (d *ClientImpl) SetLastSeen(ID uint64, t time.Time, addr string) error {
+	return d.clientStorage.Update(
+		func(tx *bolt.Tx) error {
+			Clients, er := getBucket(tx, Clients)
+			if er != nil {
+				return er
+			}
+			key := uint64ToBytes(ID)
+			value := Clients.Get(key)
+			if value == nil {
+				return fmt.Errorf("Undefined client with id %d", ID)
+			}
+			cl := deserialize(value)
+			cl.LastSeen = t
+			cl.LastAddr = addr
+			return Clients.Put(key, serialize(cl))
+		})
+}
+
 //SaveClient - Сохраняем нового клиента на диск.
 func (d *ClientImpl) SaveClient(cl *dto.ClientDescriptor) error {
 	if cl == nil {
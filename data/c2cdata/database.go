@@ -5,8 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
-	"unsafe"
+	"strings"
 
+	"github.com/blabu/egeonC2cService/auth"
 	cf "github.com/blabu/egeonC2cService/configuration"
 	"github.com/blabu/egeonC2cService/data"
 	"github.com/blabu/egeonC2cService/dto"
@@ -19,6 +20,8 @@ type boltC2cDatabase struct {
 	db *bolt.DB
 	ClientImpl
 	Messages
+	AccessImpl
+	TopicsImpl
 }
 
 var database boltC2cDatabase
@@ -30,7 +33,7 @@ func GetBoltDbInstance() data.DB {
 
 // InitC2cDB - create bolt database
 func InitC2cDB() *bolt.DB {
-	res := cf.Config.C2cStore
+	res := cf.Get().C2cStore
 	if len(res) == 0 {
 		res = "./c2c.db"
 	}
@@ -45,14 +48,87 @@ func InitC2cDB() *bolt.DB {
 		getBucket(tx, Names)
 		getBucket(tx, Clients)
 		getBucket(tx, MaxClientID)
+		getBucket(tx, Access)
+		getBucket(tx, Topics)
 		return nil
 	})
 	database.clientStorage = database.db
 	database.messageStorage = database.db
+	database.accessStorage = database.db
+	database.topicsStorage = database.db
+	database.migrateSecrets()
 	log.Info("Init database finished fine")
 	return database.db
 }
 
+// migrateSecrets - заменяет сохраненные секреты клиентов проверочными ключами
+func (d *boltC2cDatabase) migrateSecrets() {
+	cnt := 0
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		buck, err := getBucket(tx, Clients)
+		if err != nil {
+			return err
+		}
+		migrated := make(map[string][]byte)
+		buck.ForEach(func(key []byte, value []byte) error {
+			cl := deserialize(value)
+			if len(cl.SecretKey) == 0 {
+				return nil
+			}
+			if err := auth.SetVerifier(cl, cl.SecretKey, cf.Get().ScramIterations); err != nil {
+				log.Errorf("Can not migrate client %s secret %v", cl.Name, err)
+				return nil
+			}
+			migrated[string(key)] = serialize(cl)
+			return nil
+		})
+		for key, value := range migrated {
+			if err := buck.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		cnt = len(migrated)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Migrate clients secrets failed %v", err)
+		return
+	}
+	if cnt != 0 {
+		log.Infof("Secrets of %d clients replaced with verifiers", cnt)
+	}
+}
+
+// setVerifier - hash это проверочные ключи в виде salt;iterations;StoredKey;ServerKey или секрет клиента
+func setVerifier(cl *dto.ClientDescriptor, hash string) error {
+	if strings.Contains(hash, ";") {
+		return auth.ParseVerifier(cl, hash)
+	}
+	return auth.SetVerifier(cl, hash, cf.Get().ScramIterations)
+}
+
+// SetSecret - заменяет проверочные ключи клиента ID
+func (d *boltC2cDatabase) SetSecret(ID uint64, hash string) error {
+	return d.db.Update(
+		func(tx *bolt.Tx) error {
+			Clients, er := getBucket(tx, Clients)
+			if er != nil {
+				return er
+			}
+			key := uint64ToBytes(ID)
+			value := Clients.Get(key)
+			if value == nil {
+				return fmt.Errorf("Undefined client with id %d", ID)
+			}
+			cl := deserialize(value)
+			cl.SecretKey = ""
+			if err := setVerifier(cl, hash); err != nil {
+				return err
+			}
+			return Clients.Put(key, serialize(cl))
+		})
+}
+
 func (d *boltC2cDatabase) ForEach(tableName string, callBack func(key []byte, value []byte) error) {
 	d.db.View(
 		func(tx *bolt.Tx) error {
@@ -63,6 +139,10 @@ func (d *boltC2cDatabase) ForEach(tableName string, callBack func(key []byte, va
 		})
 }
 
+// getMaxID - выдает следующий идентификатор клиента типа T (см. data.NewClientID).
+// До исправления тип сдвигался на 62 бита вместо 48, поэтому у ранее выданных идентификаторов тип потерян
+// (для типа 4096 это просто 1, 2, 3...). Такие клиенты продолжают работать, но правила type:<hex> и LoginPolicies
+// к ним не применяются. Счетчик старого формата заменяется новым диапазоном, занятые идентификаторы пропускаются
 func (d *boltC2cDatabase) getMaxID(T data.ClientType) uint64 {
 	log.Tracef("Try find maxID device for %d", T)
 	tx, err := d.db.Begin(true)
@@ -80,18 +160,26 @@ func (d *boltC2cDatabase) getMaxID(T data.ClientType) uint64 {
 		log.Error(err.Error())
 		return 0
 	}
-	maxID := uint64(T)<<(64-unsafe.Sizeof(T)) | 1
+	clients, err := getBucket(tx, Clients)
+	if err != nil {
+		log.Error(err.Error())
+		return 0
+	}
+	maxID := data.NewClientID(T, 1)
 	buf := make([]byte, 2)
 	binary.LittleEndian.PutUint16(buf, uint16(T))
 	if bID := buck.Get(buf); bID != nil {
 		mxID := bytesToUint64(bID)
-		if mxID >= maxID {
+		if clType, _ := data.SplitClientID(mxID); clType == T && mxID >= maxID {
 			maxID = mxID + 1
 			log.Tracef("Max ID finded %d, %v", maxID, bID)
 		} else {
-			log.Errorf("Incorrect max ID %d, set default value %d", mxID, maxID)
+			log.Warningf("Max ID %x is incorrect or has old format, new IDs for client type %d start from %x", mxID, T, maxID)
 		}
 	}
+	for clients.Get(uint64ToBytes(maxID)) != nil {
+		maxID++
+	}
 	err = buck.Put(buf, uint64ToBytes(maxID))
 	if err != nil {
 		log.Error(err.Error())
@@ -106,13 +194,15 @@ func (d *boltC2cDatabase) GenerateRandomClient(T data.ClientType, hash string) (
 	if len(hash) < 2 {
 		return nil, errors.New("hash password is to small")
 	}
+	var cl dto.ClientDescriptor
+	if err := setVerifier(&cl, hash); err != nil {
+		return nil, err
+	}
 	max := d.getMaxID(T)
 	if max != 0 {
-		return &dto.ClientDescriptor{
-			ID:        max,
-			Name:      strconv.FormatUint(max, 16),
-			SecretKey: hash,
-		}, nil
+		cl.ID = max
+		cl.Name = strconv.FormatUint(max, 16)
+		return &cl, nil
 	}
 	return nil, fmt.Errorf("Can not generate new client undefined maxID for client type %d", T)
 }
@@ -123,14 +213,16 @@ func (d *boltC2cDatabase) GenerateClient(T data.ClientType, name, hash string) (
 	if _, er := d.getIdByName(name); er == nil {
 		return nil, fmt.Errorf("Client with name %s already exist", name)
 	}
+	var cl dto.ClientDescriptor
+	if err := setVerifier(&cl, hash); err != nil {
+		return nil, err
+	}
 	max := d.getMaxID(T)
 	log.Tracef("New ID is %d", max)
 	if max != 0 {
-		return &dto.ClientDescriptor{
-			ID:        max,
-			Name:      name,
-			SecretKey: hash,
-		}, nil
+		cl.ID = max
+		cl.Name = name
+		return &cl, nil
 	}
 	return nil, errors.New("Can not generate new client undefined maxID")
 }
@@ -0,0 +1,72 @@
+package c2cdata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	"github.com/blabu/egeonC2cService/data"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "c2cdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(conf, []byte("C2cStore: "+filepath.Join(dir, "c2c.db")+"\nScramIterations: 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.ReadConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	db := InitC2cDB()
+	if db == nil {
+		t.Fatal("Can not open database")
+	}
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGenerateClientType(t *testing.T) {
+	defer openTestDB(t)()
+	db := GetBoltDbInstance()
+	for _, clType := range []data.ClientType{4096, 1, 0xFFFF} {
+		for i := uint64(1); i <= 2; i++ {
+			cl, err := db.GenerateRandomClient(clType, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resType, seq := data.SplitClientID(cl.ID); resType != clType || seq != i {
+				t.Errorf("ID %x has type %d and number %d, expected type %d and number %d", cl.ID, resType, seq, clType, i)
+			}
+		}
+	}
+}
+
+func TestGenerateClientOldCounter(t *testing.T) {
+	defer openTestDB(t)()
+	// Счетчик и клиент в старом формате, где тип 4096 терялся при сдвиге
+	err := database.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(MaxClientID)).Put([]byte{0x00, 0x10}, uint64ToBytes(5)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(Clients)).Put(uint64ToBytes(data.NewClientID(4096, 1)), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := database.GenerateClient(4096, "client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.ID != data.NewClientID(4096, 2) {
+		t.Errorf("ID %x, expected %x", cl.ID, data.NewClientID(4096, 2))
+	}
+}
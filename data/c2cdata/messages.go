@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/blabu/egeonC2cService/dto"
+	"github.com/blabu/egeonC2cService/metrics"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -16,9 +17,18 @@ type Messages struct {
 
 //IsSended - если сообщение доставленно адресату, удаляем его из базы данных
 func (m *Messages) IsSended(userID uint64, messageID uint64) {
-	update(uint64ToBytes(userID), m.messageStorage, func(buck *bolt.Bucket) error {
-		return buck.Delete(uint64ToBytes(messageID))
+	deleted := false
+	err := update(uint64ToBytes(userID), m.messageStorage, func(buck *bolt.Bucket) error {
+		key := uint64ToBytes(messageID)
+		if buck.Get(key) == nil { // Сообщение уже удалено
+			return nil
+		}
+		deleted = true
+		return buck.Delete(key)
 	})
+	if err == nil && deleted {
+		metrics.OfflineDelivered.Inc()
+	}
 }
 
 //Add - в случае если сообщение не было доставлено добавляем его в базу данных
@@ -36,9 +46,20 @@ func (m *Messages) Add(userID uint64, msg dto.UnSendedMsg) (uint64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("Can not add message from %s to %d", msg.From, userID)
 	}
+	metrics.OfflineStored.Inc()
 	return messageID, nil
 }
 
+//Count - количество не доставленных сообщений для клиента
+func (m *Messages) Count(userID uint64) int {
+	cnt := 0
+	view(uint64ToBytes(userID), m.messageStorage, func(buck *bolt.Bucket) error {
+		cnt = buck.Stats().KeyN
+		return nil
+	})
+	return cnt
+}
+
 //GetNext - получить следующее не доставленое сообщение для клиента
 func (m *Messages) GetNext(userID uint64) (dto.UnSendedMsg, error) {
 	var msg dto.UnSendedMsg
@@ -0,0 +1,39 @@
+package c2cdata
+
+import (
+	"encoding/json"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type TopicsImpl struct {
+	topicsStorage *bolt.DB
+}
+
+//GetTopics - список топиков, на которые клиент ID подписан постоянно
+func (t *TopicsImpl) GetTopics(ID uint64) ([]string, error) {
+	var topics []string
+	err := view([]byte(Topics), t.topicsStorage, func(buck *bolt.Bucket) error {
+		value := buck.Get(uint64ToBytes(ID))
+		if value == nil {
+			return errors.New("Topics are undefined")
+		}
+		return json.Unmarshal(value, &topics)
+	})
+	return topics, err
+}
+
+//SetTopics - сохраняет постоянные подписки клиента ID. Пустой список удаляет их
+func (t *TopicsImpl) SetTopics(ID uint64, topics []string) error {
+	return update([]byte(Topics), t.topicsStorage, func(buck *bolt.Bucket) error {
+		if len(topics) == 0 {
+			return buck.Delete(uint64ToBytes(ID))
+		}
+		value, err := json.Marshal(topics)
+		if err != nil {
+			return err
+		}
+		return buck.Put(uint64ToBytes(ID), value)
+	})
+}
@@ -1,18 +1,39 @@
 package data
 
-import "github.com/blabu/egeonC2cService/dto"
+import (
+	"time"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
 
 //IClient - БАЗОВЫЙ интерфейс для клиент-клиент взаимодействия (Сделан для тестов)
 type IClient interface {
 	GetClient(ID uint64) (*dto.ClientDescriptor, error)
-	DelClient(ID uint64) error
+	DelClient(ID uint64) error // Удаляет клиента вместе с его правилами доступа, подписками и не доставленными сообщениями
 	GetClientID(name string) (uint64, error)
 	SaveClient(cl *dto.ClientDescriptor) error
+	SetLastSeen(ID uint64, t time.Time, addr string) error
+	SetSecret(ID uint64, hash string) error // Заменяет проверочные ключи клиента, hash - секрет или проверочные ключи
 }
 
 //ClientType - первые байты в идентиифкаторе клиента
 type ClientType uint16
 
+// clientTypeShift - тип клиента хранится в старших 16 битах идентификатора, порядковый номер в младших 48
+const clientTypeShift = 48
+
+const clientSeqMask = 1<<clientTypeShift - 1
+
+// NewClientID - идентификатор клиента типа T с порядковым номером seq
+func NewClientID(T ClientType, seq uint64) uint64 {
+	return uint64(T)<<clientTypeShift | seq&clientSeqMask
+}
+
+// SplitClientID - разбивает идентификатор клиента на тип и порядковый номер
+func SplitClientID(ID uint64) (ClientType, uint64) {
+	return ClientType(ID >> clientTypeShift), ID & clientSeqMask
+}
+
 //IClientGenerator - Функции генерации нового клиента
 type IClientGenerator interface {
 	// GenerateRandomClient - Генерируем нового клиента, имя которого будет совпадать с его идентификационным номером
@@ -26,6 +47,19 @@ type IMessage interface {
 	IsSended(userID uint64, messageID uint64)
 	Add(userID uint64, msg dto.UnSendedMsg) (uint64, error)
 	GetNext(userID uint64) (dto.UnSendedMsg, error)
+	Count(userID uint64) int // Количество не доставленных сообщений для клиента
+}
+
+//IAccess - правила доступа, кто может подключаться к клиенту
+type IAccess interface {
+	GetAccess(ID uint64) ([]string, error)
+	SetAccess(ID uint64, rules []string) error
+}
+
+//ITopics - постоянные подписки клиентов на топики
+type ITopics interface {
+	GetTopics(ID uint64) ([]string, error)
+	SetTopics(ID uint64, topics []string) error
 }
 
 //DB - интерфейс базы данных работы платформы сообщений
@@ -33,5 +67,7 @@ type DB interface {
 	IClientGenerator
 	IClient
 	IMessage
+	IAccess
+	ITopics
 	ForEach(tableName string, callBack func(key []byte, value []byte) error)
 }
@@ -18,4 +18,13 @@ const (
 	DestroyConCOMMAND    uint16 = 10
 	PropertiesCOMMAND    uint16 = 11
 	SaveDataCOMMAND      uint16 = 12
+	PeerInitCOMMAND      uint16 = 13 // Авторизация соседнего сервера федерации
+	AccessCOMMAND        uint16 = 14 // Управление списком клиентов, которым разрешено подключаться
+	ApproveCOMMAND       uint16 = 15 // Подтверждение запроса на соединение
+	SubscribeCOMMAND     uint16 = 16 // Подписка на топик
+	UnsubscribeCOMMAND   uint16 = 17 // Отписка от топика
+	PublishCOMMAND       uint16 = 18 // Отправка сообщения всем подписчикам топика
+	PresenceCOMMAND      uint16 = 19 // Уведомление о подключении и отключении клиента
+	ResumeCOMMAND        uint16 = 20 // Продолжение сессии после разрыва соединения
+	ShutdownCOMMAND      uint16 = 21 // Уведомление об остановке сервера, после него соединение закрывается
 )
@@ -5,7 +5,13 @@ import "time"
 // ClientDescriptor - base entity for client to client messanger
 type ClientDescriptor struct {
 	ID           uint64    `json:"ID"`
-	Name         string    `json:"Name"` /*Начинается ОБЯЗАТЕЛЬНО с буквы латинского алфавита*/
-	SecretKey    string    `json:"Key"`
+	Name         string    `json:"Name"`          /*Начинается ОБЯЗАТЕЛЬНО с буквы латинского алфавита*/
+	SecretKey    string    `json:"Key,omitempty"` // Устаревший секрет base64(SHA256(name+password)), заменяется проверочными ключами при открытии базы
+	Salt         string    `json:"Salt"`          // Соль для PBKDF2 (base64)
+	Iterations   uint32    `json:"Iterations"`    // Количество итераций PBKDF2
+	StoredKey    string    `json:"StoredKey"`     // SHA256(ClientKey) (base64)
+	ServerKey    string    `json:"ServerKey"`     // Ключ для подписи ответа сервера (base64)
 	RegisterDate time.Time `json:"Registered"`
+	LastSeen     time.Time `json:"LastSeen"` // Время последнего отключения клиента
+	LastAddr     string    `json:"LastAddr"` // Адрес, с которого клиент был подключен последний раз
 }
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/google/logger v1.1.0
+	github.com/gorilla/websocket v1.4.2
 	go.etcd.io/bbolt v1.3.5
 	go.uber.org/atomic v1.7.0
 	gopkg.in/yaml.v2 v2.4.0
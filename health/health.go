@@ -0,0 +1,67 @@
+/*
+Package health - состояние сервера для проверок балансировщиков нагрузки.
+
+	/healthz - сервер работает (всегда 200)
+	/readyz  - сервер готов принимать клиентов: 200 или 503 со списком проблем
+*/
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var problems = struct {
+	list map[string]string // Причины неготовности сервера по названию подсистемы
+	mtx  sync.RWMutex
+}{list: make(map[string]string)}
+
+// SetProblem - сервер не готов из-за подсистемы name
+func SetProblem(name, text string) {
+	problems.mtx.Lock()
+	defer problems.mtx.Unlock()
+	problems.list[name] = text
+}
+
+// ClearProblem - подсистема name снова работает
+func ClearProblem(name string) {
+	problems.mtx.Lock()
+	defer problems.mtx.Unlock()
+	delete(problems.list, name)
+}
+
+// Problems - список причин неготовности сервера, пустой если сервер готов
+func Problems() []string {
+	problems.mtx.RLock()
+	defer problems.mtx.RUnlock()
+	res := make([]string, 0, len(problems.list))
+	for name, text := range problems.list {
+		res = append(res, name+": "+text)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LiveHandler - обработчик проверки работоспособности
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// ReadyHandler - обработчик проверки готовности
+func ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := Problems()
+		if len(list) == 0 {
+			fmt.Fprintln(w, "ready")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, text := range list {
+			fmt.Fprintln(w, text)
+		}
+	})
+}
@@ -15,12 +15,16 @@ type LogFileType struct {
 	file       *os.File
 	logWrapper *logger.Logger
 	mtx        sync.RWMutex
+	path       string        // Папка для файлов логов
+	period     time.Duration // Период смены файла
+	reopen     chan struct{} // Сигнал сменить файл не дожидаясь окончания периода
 }
 
 var log LogFileType
 
 func init() {
 	log.logWrapper = logger.Init("c2cService", true, false, os.Stdout)
+	log.reopen = make(chan struct{}, 1)
 }
 
 //GetLogger - вернет дефолтный логгер
@@ -28,23 +32,27 @@ func GetLogger() *LogFileType {
 	return &log
 }
 
-// newFile - Регистрирует новый файл (держим на него ссылку пока не вызовем функцию Close)
+// newFile - Регистрирует новый файл и логгер для него, прежний логгер закрывается вместе со своим файлом
 func (l *LogFileType) newFile(f *os.File) {
-	if l.file != nil {
-		l.logWrapper.Infof("Close old file %s", l.file.Name())
-		err := l.file.Close()
-		if err != nil {
-			l.logWrapper.Infof("Error when try close file %s", err.Error())
-		}
-	} else {
+	l.mtx.Lock()
+	oldFile, oldWrapper := l.file, l.logWrapper
+	l.file = f
+	l.logWrapper = logger.Init("telemetryAPI", true, false, f)
+	l.mtx.Unlock()
+	if oldFile == nil { // Первый логгер пишет в os.Stdout, его не закрываем
 		logger.Warning("Old file is nil")
+		return
 	}
-	l.file = f
+	// Новые записи уже идут в новый логгер, прежний никто не использует
+	oldWrapper.Infof("Close old file %s", oldFile.Name())
+	oldWrapper.Close()
 }
 
 //closeFile - Закрывает файл уничтожает ссылку
 func (l *LogFileType) closeFile() {
 	logger.Info("Try close file wrapper")
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
 	if l.file != nil {
 		l.logWrapper.Infof("Close old file %s", l.file.Name())
 		l.file.Close()
@@ -60,7 +68,13 @@ func (l *LogFileType) closeFile() {
 // ChangeFile - Запускает периодическое изменение имени файла куда сохраняются логи
 func (l *LogFileType) ChangeFile(addrPath string, dT time.Duration) {
 	defer l.closeFile()
+	l.mtx.Lock()
+	l.path, l.period = addrPath, dT
+	l.mtx.Unlock()
 	for {
+		l.mtx.RLock()
+		addrPath, dT = l.path, l.period
+		l.mtx.RUnlock()
 		var logFilePath strings.Builder
 		logFilePath.WriteString(addrPath)
 		logFilePath.WriteString("/log ")
@@ -68,21 +82,32 @@ func (l *LogFileType) ChangeFile(addrPath string, dT time.Duration) {
 		logFilePath.WriteString(".txt")
 		logFile, err := os.OpenFile(logFilePath.String(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
-			if l.logWrapper == nil {
-				logger.Errorf("Error when try open a file for loging %s, %s", logFilePath, err.Error())
-			} else {
-				l.logWrapper.Errorf("Error when try open a file for loging %s, %s", logFilePath, err.Error())
+			l.mtx.RLock()
+			l.logWrapper.Errorf("Error when try open a file for loging %s, %s", logFilePath.String(), err.Error())
+			opened := l.file != nil
+			l.mtx.RUnlock()
+			if !opened {
+				return
 			}
-			return
+			// Логи продолжают писаться в прежний файл
+		} else {
+			l.newFile(logFile)
+		}
+		select {
+		case <-time.After(dT):
+		case <-l.reopen:
 		}
-		l.newFile(logFile)
-		func(l *LogFileType, dT time.Duration) {
-			l.mtx.Lock()
-			l.logWrapper = logger.Init("telemetryAPI", true, false, l.file)
-			l.mtx.Unlock()
-			defer l.logWrapper.Close()
-			time.Sleep(dT)
-		}(l, dT)
+	}
+}
+
+// SetFile - меняет папку и период смены файла для запущенного ChangeFile, новый файл открывается сразу
+func (l *LogFileType) SetFile(addrPath string, dT time.Duration) {
+	l.mtx.Lock()
+	l.path, l.period = addrPath, dT
+	l.mtx.Unlock()
+	select {
+	case l.reopen <- struct{}{}:
+	default:
 	}
 }
 
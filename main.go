@@ -2,48 +2,71 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	lg "log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/blabu/egeonC2cService/admin"
+	"github.com/blabu/egeonC2cService/client/c2cService"
 	cf "github.com/blabu/egeonC2cService/configuration"
 	c2cData "github.com/blabu/egeonC2cService/data/c2cdata"
+	"github.com/blabu/egeonC2cService/health"
 	log "github.com/blabu/egeonC2cService/logWrapper"
+	"github.com/blabu/egeonC2cService/metrics"
 	"github.com/blabu/egeonC2cService/server"
 	"go.uber.org/atomic"
 )
 
-var confPath = flag.String("conf", "./config.conf", "Set path to config file")
+var confPath = flag.String("conf", "config.yaml", "Set path to config file")
+var checkConfig = flag.Bool("check-config", false, "Print effective config and exit, exit code is not zero if config is invalid")
 
 var sigTerm chan os.Signal
 
+const closeSessionsTimeOut = 5 * time.Second    // Время ожидания сессий после принудительного закрытия их соединений
+
 func init() {
 	flag.Parse()
+	if *checkConfig {
+		if err := cf.Check(*confPath, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	log.Infof("Try read configuration file %s\n", *confPath)
 	if err := cf.ReadConfig(*confPath); err != nil {
-		log.Fatal("Undefined Configuration file. " + err.Error())
+		log.Fatalf("Can not read configuration file %s %v", *confPath, err)
 	}
 	sigTerm = make(chan os.Signal)
 }
 
-func initLogger() {
-	logFilePath := cf.Config.LogPath
-	var minutes = uint32(cf.Config.SaveDuration) * 60
+// logSettings - папка для логов и период смены файла логов
+func logSettings() (string, time.Duration) {
+	var minutes = uint32(cf.Get().SaveDuration) * 60
 	if minutes == 0 {
-		minutes = uint32(60) * 24 // Раз в сутки по умолчанию
+		minutes = cf.DefaultSaveDuration * 60
 	}
-	go log.GetLogger().ChangeFile(logFilePath, time.Duration(minutes)*time.Minute)
+	return cf.Get().LogPath, time.Duration(minutes) * time.Minute
+}
+
+func initLogger() {
+	go log.GetLogger().ChangeFile(logSettings())
 	log.SetFlags(lg.Ldate | lg.Ltime | lg.Lshortfile)
 }
 
 func getTCPListener() net.Listener {
-	port := cf.Config.ServerTCPPort
+	port := cf.Get().ServerTCPPort
 	if len(port) == 0 {
 		log.Fatal("Undefined ServerTcpPort parameter")
 		return nil
@@ -53,30 +76,128 @@ func getTCPListener() net.Listener {
 		log.Fatalf("Can not run listener at port %s %v", port, err)
 		return nil
 	}
+	if listen, err = withProxyProtocol(listen, "tcp"); err != nil {
+		log.Fatalf("Can not run listener at port %s %v", port, err)
+		return nil
+	}
 	log.Info("Start TCP server at ", port)
 	return listen
 }
 
+// getTLSConfig - настройки TLS слушателей, сертификаты берутся из certificates и перечитываются по SIGHUP
+func getTLSConfig() (*tls.Config, error) {
+	if !certificates.loaded() {
+		if err := certificates.load(); err != nil {
+			return nil, err
+		}
+	}
+	return &tls.Config{
+		GetCertificate:     certificates.getCertificate,
+		GetConfigForClient: certificates.getConfigForClient,
+	}, nil
+}
+
+// setClientCA - включает проверку сертификатов клиентов центрами сертификации из ClientCAPath
+func setClientCA(conf *tls.Config) error {
+	caPath := cf.Get().ClientCAPath
+	if len(caPath) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("Undefine client CA certificates in " + caPath)
+	}
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if cf.Get().ClientCertRequired {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
 func getTLSListener() (net.Listener, error) {
-	if portTLS := cf.Config.ServerTLSPort; len(portTLS) == 0 {
+	if portTLS := cf.Get().ServerTLSPort; len(portTLS) == 0 {
 		return nil, errors.New("Undefine tls port for server")
-	} else if certPath := cf.Config.CertificatePath; len(certPath) == 0 {
-		return nil, errors.New("Undefine certificate path")
-	} else if privateKeyPath := cf.Config.PrivateKeyPath; len(privateKeyPath) == 0 {
-		return nil, errors.New("Undefine private key path")
-	} else if certificate, err := tls.LoadX509KeyPair(certPath, privateKeyPath); err != nil {
+	} else if conf, err := getTLSConfig(); err != nil {
 		return nil, err
 	} else if localSrv, err := net.Listen("tcp", portTLS); err != nil {
 		return nil, err
+	} else if localSrv, err = withProxyProtocol(localSrv, "tls"); err != nil {
+		return nil, err
 	} else {
-		conf := &tls.Config{Certificates: []tls.Certificate{certificate}}
 		server := tls.NewListener(localSrv, conf)
 		log.Info("Start TLS server at ", portTLS)
 		return server, nil
 	}
 }
 
-func startServer(listen net.Listener, timeout time.Duration) {
+func getWSListener() (net.Listener, error) {
+	portWS := cf.Get().ServerWSPort
+	if len(portWS) == 0 {
+		return nil, errors.New("Undefine websocket port for server")
+	}
+	localSrv, err := net.Listen("tcp", portWS)
+	if err != nil {
+		return nil, err
+	}
+	if localSrv, err = withProxyProtocol(localSrv, "ws"); err != nil {
+		return nil, err
+	}
+	if cf.Get().WSUseTLS {
+		conf, err := getTLSConfig()
+		if err != nil {
+			localSrv.Close()
+			return nil, err
+		}
+		localSrv = tls.NewListener(localSrv, conf)
+	}
+	log.Infof("Start WebSocket server at %s%s", portWS, cf.Get().WSPath)
+	return server.NewWebSocketListener(localSrv, cf.Get().WSPath), nil
+}
+
+// withProxyProtocol - если для слушателя name включен PROXY протокол, адрес клиента будет взят из заголовка балансировщика.
+// При ошибке listen закрывается
+func withProxyProtocol(listen net.Listener, name string) (net.Listener, error) {
+	for _, val := range cf.Get().ProxyProtocol {
+		if strings.EqualFold(val, name) {
+			res, err := server.NewProxyListener(listen, cf.Get().ProxyTrusted)
+			if err != nil {
+				listen.Close()
+				return nil, err
+			}
+			log.Infof("PROXY protocol is enabled for %s listener at %s", name, listen.Addr())
+			return res, nil
+		}
+	}
+	return listen, nil
+}
+
+// startStatusServer - запускает HTTP сервер с метриками в формате Prometheus по пути /metrics
+// и проверками работоспособности /healthz и готовности /readyz
+func startStatusServer(addr string) (*http.Server, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", health.LiveHandler())
+	mux.Handle("/readyz", health.ReadyHandler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(listen); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Status server finished with error %v", err)
+		}
+	}()
+	log.Info("Start status server at ", addr)
+	return srv, nil
+}
+
+func startServer(listen net.Listener, name string) {
 	Con, err := listen.Accept() // Ждущая функция (Висим ждем соединения)
 	if err != nil {
 		if nerr, ok := err.(net.Error); ok && nerr.Temporary() { //check type of error is network error
@@ -88,40 +209,104 @@ func startServer(listen net.Listener, timeout time.Duration) {
 		return
 	}
 	log.Info("Create new connection from ", Con.RemoteAddr().String())
-	go server.StartNewSession(Con, timeout*time.Second)
+	timeout := time.Duration(cf.Get().SessionTimeOut) * time.Second
+	go server.StartNewSession(Con, timeout, name)
 }
 
 func main() {
 	// Подписываемся на оповещение, когда операционка захочет нас прибить
-	signal.Notify(sigTerm, os.Interrupt, os.Kill, syscall.SIGQUIT)
+	signal.Notify(sigTerm, os.Interrupt, os.Kill, syscall.SIGQUIT, syscall.SIGTERM)
 	initLogger()
-	timeout := time.Duration(cf.Config.SessionTimeOut) * time.Second
-	defer c2cData.InitC2cDB().Close()
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for range sigHup {
+			reloadConfig()
+		}
+	}()
+	if db := c2cData.InitC2cDB(); db != nil {
+		defer db.Close()
+	} else {
+		health.SetProblem("database", "Can not open database")
+	}
+	c2cService.StartFederation(c2cData.GetBoltDbInstance())
 	isStoped := atomic.NewBool(false)
 	tlsListener, err := getTLSListener()
 	if err != nil {
 		log.Error(err.Error())
+		if len(cf.Get().ServerTLSPort) != 0 {
+			health.SetProblem("tls", err.Error())
+		}
 	} else {
 		go func() {
 			for !isStoped.Load() {
-				startServer(tlsListener, timeout)
+				startServer(tlsListener, "tls")
 			}
 			log.Info("Finish tls service")
 		}()
 	}
+	wsListener, err := getWSListener()
+	if err != nil {
+		log.Info(err.Error())
+		if len(cf.Get().ServerWSPort) != 0 {
+			health.SetProblem("websocket", err.Error())
+		}
+	} else {
+		go func() {
+			for !isStoped.Load() {
+				startServer(wsListener, "ws")
+			}
+			log.Info("Finish websocket service")
+		}()
+	}
 	tcpListener := getTCPListener()
 	go func() {
 		for !isStoped.Load() {
-			startServer(tcpListener, timeout)
+			startServer(tcpListener, "tcp")
 		}
 		log.Info("Finish tcp service")
 	}()
+	if len(cf.Get().AdminPort) != 0 {
+		adminServer, err := admin.Start(cf.Get().AdminPort, c2cData.GetBoltDbInstance())
+		if err != nil {
+			log.Error(err.Error())
+		} else {
+			defer adminServer.Close()
+		}
+	}
+	if len(cf.Get().MetricsPort) != 0 {
+		statusServer, err := startStatusServer(cf.Get().MetricsPort)
+		if err != nil {
+			log.Error(err.Error())
+		} else {
+			defer statusServer.Close()
+		}
+	}
 	<-sigTerm
 	isStoped.Store(true)
+	health.SetProblem("shutdown", "Server is stopping")
 	log.Info("Operation system kill server")
 	tcpListener.Close()
 	if tlsListener != nil {
 		log.Info("Try close tls connection")
 		tlsListener.Close()
 	}
+	if wsListener != nil {
+		log.Info("Try close websocket connection")
+		wsListener.Close()
+	}
+	c2cService.Shutdown()
+	shutdownTimeOut := time.Duration(cf.Get().ShutdownTimeOut) * time.Second
+	if shutdownTimeOut == 0 {
+		shutdownTimeOut = cf.DefaultShutdownTimeOut * time.Second
+	}
+	if server.WaitSessions(shutdownTimeOut) {
+		log.Info("All sessions are finished")
+		return
+	}
+	// База закрывается после выхода из main, сессии должны успеть сохранить недоставленные сообщения
+	log.Warningf("Sessions are not finished in %v, close %d connections", shutdownTimeOut, server.CloseSessions())
+	if !server.WaitSessions(closeSessionsTimeOut) {
+		log.Errorf("Sessions are not finished in %v after closing connections", closeSessionsTimeOut)
+	}
 }
@@ -0,0 +1,296 @@
+/*
+Package metrics - счетчики и показатели работы сервера в текстовом формате Prometheus
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector - метрика, которую можно вывести в текстовом формате Prometheus
+type collector interface {
+	kind() string // counter, gauge или histogram
+	write(w io.Writer, name string)
+}
+
+type metric struct {
+	name string
+	help string
+	c    collector
+}
+
+var registry struct {
+	list []metric
+	mtx  sync.Mutex
+}
+
+func register(name, help string, c collector) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.list = append(registry.list, metric{name: name, help: help, c: c})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeValue(w io.Writer, name, label, value string, val float64) {
+	if len(label) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(val, 'g', -1, 64))
+		return
+	}
+	fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, labelEscaper.Replace(value), strconv.FormatFloat(val, 'g', -1, 64))
+}
+
+// Counter - монотонно растущий счетчик, безопасен для использования из разных потоков
+type Counter struct {
+	val uint64
+}
+
+// NewCounter - создает и регистрирует счетчик
+func NewCounter(name, help string) *Counter {
+	c := new(Counter)
+	register(name, help, c)
+	return c
+}
+
+// Inc - увеличивает счетчик на единицу
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.val, 1)
+}
+
+// Add - увеличивает счетчик на n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.val, n)
+}
+
+// Value - текущее значение счетчика
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.val)
+}
+
+func (c *Counter) kind() string { return "counter" }
+
+func (c *Counter) write(w io.Writer, name string) {
+	writeValue(w, name, "", "", float64(c.Value()))
+}
+
+// Gauge - показатель, который может как расти так и уменьшаться
+type Gauge struct {
+	val int64
+}
+
+// Add - изменяет показатель на n
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.val, n)
+}
+
+// Value - текущее значение показателя
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.val)
+}
+
+// CounterVec - набор счетчиков с одной меткой
+type CounterVec struct {
+	label string
+	list  map[string]*Counter
+	mtx   sync.RWMutex
+}
+
+// NewCounterVec - создает и регистрирует набор счетчиков с меткой label
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{label: label, list: make(map[string]*Counter)}
+	register(name, help, v)
+	return v
+}
+
+// With - счетчик для значения метки value
+func (v *CounterVec) With(value string) *Counter {
+	v.mtx.RLock()
+	c, ok := v.list[value]
+	v.mtx.RUnlock()
+	if ok {
+		return c
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if c, ok = v.list[value]; !ok {
+		c = new(Counter)
+		v.list[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) kind() string { return "counter" }
+
+func (v *CounterVec) write(w io.Writer, name string) {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	values := make([]string, 0, len(v.list))
+	for value := range v.list {
+		values = append(values, value)
+	}
+	for _, value := range sortLabels(values) {
+		writeValue(w, name, v.label, value, float64(v.list[value].Value()))
+	}
+}
+
+// GaugeVec - набор показателей с одной меткой
+type GaugeVec struct {
+	label string
+	list  map[string]*Gauge
+	mtx   sync.RWMutex
+}
+
+// NewGaugeVec - создает и регистрирует набор показателей с меткой label
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	v := &GaugeVec{label: label, list: make(map[string]*Gauge)}
+	register(name, help, v)
+	return v
+}
+
+// With - показатель для значения метки value
+func (v *GaugeVec) With(value string) *Gauge {
+	v.mtx.RLock()
+	g, ok := v.list[value]
+	v.mtx.RUnlock()
+	if ok {
+		return g
+	}
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if g, ok = v.list[value]; !ok {
+		g = new(Gauge)
+		v.list[value] = g
+	}
+	return g
+}
+
+func (v *GaugeVec) kind() string { return "gauge" }
+
+func (v *GaugeVec) write(w io.Writer, name string) {
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	values := make([]string, 0, len(v.list))
+	for value := range v.list {
+		values = append(values, value)
+	}
+	for _, value := range sortLabels(values) {
+		writeValue(w, name, v.label, value, float64(v.list[value].Value()))
+	}
+}
+
+// GaugeFunc - набор показателей с одной меткой, которые вычисляются в момент чтения метрик
+type GaugeFunc struct {
+	label string
+	f     atomic.Value // func() map[string]int
+}
+
+// NewGaugeFunc - создает и регистрирует вычисляемый набор показателей с меткой label
+func NewGaugeFunc(name, help, label string) *GaugeFunc {
+	g := &GaugeFunc{label: label}
+	register(name, help, g)
+	return g
+}
+
+// Set - задает функцию, которая вернет значения показателей по значению метки
+func (g *GaugeFunc) Set(f func() map[string]int) {
+	g.f.Store(f)
+}
+
+func (g *GaugeFunc) kind() string { return "gauge" }
+
+func (g *GaugeFunc) write(w io.Writer, name string) {
+	f, ok := g.f.Load().(func() map[string]int)
+	if !ok {
+		return
+	}
+	list := f()
+	values := make([]string, 0, len(list))
+	for value := range list {
+		values = append(values, value)
+	}
+	for _, value := range sortLabels(values) {
+		writeValue(w, name, g.label, value, float64(list[value]))
+	}
+}
+
+// Histogram - распределение наблюдаемых значений по корзинам
+type Histogram struct {
+	buckets []float64 // Верхние границы корзин по возрастанию
+	counts  []uint64
+	sum     float64
+	count   uint64
+	mtx     sync.Mutex
+}
+
+// NewHistogram - создает и регистрирует распределение с верхними границами корзин buckets
+func NewHistogram(name, help string, buckets ...float64) *Histogram {
+	h := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(name, help, h)
+	return h
+}
+
+// Observe - добавляет наблюдаемое значение
+func (h *Histogram) Observe(val float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, val); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += val
+	h.count++
+}
+
+func (h *Histogram) kind() string { return "histogram" }
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var cnt uint64
+	for i, le := range h.buckets {
+		cnt += h.counts[i]
+		writeValue(w, name+"_bucket", "le", strconv.FormatFloat(le, 'g', -1, 64), float64(cnt))
+	}
+	writeValue(w, name+"_bucket", "le", "+Inf", float64(h.count))
+	writeValue(w, name+"_sum", "", "", h.sum)
+	writeValue(w, name+"_count", "", "", float64(h.count))
+}
+
+// sortLabels - сортирует значения метки, числа по возрастанию значения
+func sortLabels(values []string) []string {
+	sort.Slice(values, func(i, j int) bool {
+		a, errA := strconv.ParseFloat(values[i], 64)
+		b, errB := strconv.ParseFloat(values[j], 64)
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return values[i] < values[j]
+	})
+	return values
+}
+
+// WriteText - выводит все метрики в текстовом формате Prometheus
+func WriteText(w io.Writer) {
+	registry.mtx.Lock()
+	list := make([]metric, len(registry.list))
+	copy(list, registry.list)
+	registry.mtx.Unlock()
+	for _, m := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.c.kind())
+		m.c.write(w, m.name)
+	}
+}
+
+// Handler - HTTP обработчик, который отдает все метрики
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
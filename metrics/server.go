@@ -0,0 +1,37 @@
+package metrics
+
+// Метрики сервера
+
+// Sessions - открытые сессии по слушателям (tcp, tls, ws)
+var Sessions = NewGaugeVec("c2c_sessions", "Open sessions by listener", "listener")
+
+// SessionDuration - длительность завершенных сессий в секундах
+var SessionDuration = NewHistogram("c2c_session_duration_seconds", "Duration of finished sessions",
+	1, 10, 60, 300, 1800, 3600, 6*3600, 24*3600)
+
+// OnlineClients - онлайн клиенты по типу клиента (старшие 16 бит идентификатора)
+var OnlineClients = NewGaugeFunc("c2c_online_clients", "Online clients by client type", "type")
+
+// Messages - сообщения, полученные от клиентов, по командам (неизвестные команды - other)
+var Messages = NewCounterVec("c2c_messages_total", "Messages received from clients by command", "command")
+
+// ParseErrors - ошибки разбора пакетов
+var ParseErrors = NewCounter("c2c_parse_errors_total", "Packets that can not be parsed")
+
+// BytesIn - байты, принятые из всех соединений
+var BytesIn = NewCounter("c2c_received_bytes_total", "Bytes received from all connections")
+
+// BytesOut - байты, записанные во все соединения
+var BytesOut = NewCounter("c2c_sent_bytes_total", "Bytes sent to all connections")
+
+// OfflineStored - сообщения, сохраненные для клиентов, которым их не удалось доставить
+var OfflineStored = NewCounter("c2c_offline_stored_total", "Undelivered messages saved for later delivery")
+
+// OfflineDelivered - сохраненные сообщения, доставленные клиентам позже
+var OfflineDelivered = NewCounter("c2c_offline_delivered_total", "Saved messages delivered later")
+
+// AuthFailures - ошибки авторизации клиентов по типу ошибки
+var AuthFailures = NewCounterVec("c2c_auth_failures_total", "Failed client authorizations by error type", "type")
+
+// SlowConsumers - количество соединений, разорванных из-за того, что клиент не успевал читать
+var SlowConsumers = NewCounter("c2c_slow_consumers_total", "Connections closed because client reads too slowly")
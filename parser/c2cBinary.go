@@ -0,0 +1,153 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
+
+// *Бинарная версия протокола (2).
+// *$V<v><cmd><jmp><id><from><to><size>................
+// *Заголовок начинается с той же магической последовательности $V, но версия передается одним байтом (0x02),
+// *поэтому она никогда не совпадает с ASCII символом версии текстового протокола
+// *cmd - тип сообщения (беззнаковый varint)
+// *jmp - кол-во прыжков (беззнаковый varint)
+// *id - идентификатор сообщения (беззнаковый varint)
+// *from, to - адрес, первый байт которого тип адреса:
+// *	0 - идентификатор клиента (беззнаковый varint), в сообщении представлен строкой в шестнадцатиричном виде
+// *	1 - имя клиента (беззнаковый varint длина строки + сама строка)
+// *size - размер передаваемых данных (беззнаковый varint)
+// *
+// *Пример: 24 56 02 09 03 00 00 1F 00 20 04 DATA
+
+const binaryProtocolVersion = 2
+
+const (
+	addrID   byte = 0
+	addrName byte = 1
+)
+
+// minBinaryHeaderSize - $V + версия + cmd + jmp + id + два адреса (тип + значение) + size
+const minBinaryHeaderSize = 2 + 1 + 1 + 1 + 1 + 2*2 + 1
+
+// errShortHeader - заголовок получен не полностью, надо дочитать данные
+var errShortHeader = errors.New("Not full header")
+
+func appendUvarint(res []byte, val uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], val)
+	return append(res, buf[:n]...)
+}
+
+// appendAddr - добавляет адрес в компактном виде. Идентификатор пишется как число
+// только если обратное преобразование даст ту же самую строку
+func appendAddr(res []byte, addr string) []byte {
+	if id, err := strconv.ParseUint(addr, 16, 64); err == nil && strconv.FormatUint(id, 16) == addr {
+		res = append(res, addrID)
+		return appendUvarint(res, id)
+	}
+	res = append(res, addrName)
+	res = appendUvarint(res, uint64(len(addr)))
+	return append(res, addr...)
+}
+
+func formBinaryMessage(msg dto.Message) []byte {
+	res := make([]byte, 0, minBinaryHeaderSize+2*binary.MaxVarintLen64+len(msg.From)+len(msg.To)+len(msg.Content))
+	res = append(res, beginHeader...)
+	res = append(res, binaryProtocolVersion)
+	res = appendUvarint(res, uint64(msg.Command))
+	res = appendUvarint(res, uint64(msg.Jmp))
+	res = appendUvarint(res, msg.ID)
+	res = appendAddr(res, msg.From)
+	res = appendAddr(res, msg.To)
+	res = appendUvarint(res, uint64(len(msg.Content)))
+	return append(res, msg.Content...)
+}
+
+// binaryReader - последовательное чтение полей бинарного заголовка
+type binaryReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	val, n := binary.Uvarint(r.data[r.pos:])
+	if n == 0 {
+		return 0, errShortHeader
+	}
+	if n < 0 {
+		return 0, errors.New("Incorrect varint value in header")
+	}
+	r.pos += n
+	return val, nil
+}
+
+func (r *binaryReader) addr() (string, error) {
+	if r.pos >= len(r.data) {
+		return "", errShortHeader
+	}
+	t := r.data[r.pos]
+	r.pos++
+	switch t {
+	case addrID:
+		id, err := r.uvarint()
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatUint(id, 16), nil
+	case addrName:
+		size, err := r.uvarint()
+		if err != nil {
+			return "", err
+		}
+		if size > maxHeaderSize {
+			return "", fmt.Errorf("Address is too long %d", size)
+		}
+		if r.pos+int(size) > len(r.data) {
+			return "", errShortHeader
+		}
+		res := string(r.data[r.pos : r.pos+int(size)])
+		r.pos += int(size)
+		return res, nil
+	default:
+		return "", fmt.Errorf("Undefined address type %d", t)
+	}
+}
+
+// parseBinaryHeader - разбирает бинарный заголовок, data начинается с магической последовательности
+func (c2c *C2cParser) parseBinaryHeader(data []byte) error {
+	r := binaryReader{data: data, pos: len(beginHeader) + 1}
+	var err error
+	if c2c.head.mType, err = r.uvarint(); err != nil {
+		return err
+	}
+	if c2c.head.jumpCnt, err = r.uvarint(); err != nil {
+		return err
+	}
+	if c2c.head.id, err = r.uvarint(); err != nil {
+		return err
+	}
+	if c2c.head.from, err = r.addr(); err != nil {
+		return err
+	}
+	if c2c.head.to, err = r.addr(); err != nil {
+		return err
+	}
+	s, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	if c2c.head.jumpCnt == 0 {
+		return errors.New("Jump count is zero")
+	}
+	if s > c2c.maxPackageSize {
+		return fmt.Errorf("Income package is too big %d. Overflow internal buffer %d", s, c2c.maxPackageSize)
+	}
+	c2c.head.protocolVer = binaryProtocolVersion
+	c2c.head.contentSize = int(s)
+	c2c.head.headerSize = r.pos
+	return nil
+}
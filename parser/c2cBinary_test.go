@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
+
+func TestAppendAddr(t *testing.T) {
+	cases := []struct {
+		addr     string
+		addrType byte
+	}{
+		{"1000000000000001", addrID},
+		{"ff", addrID},
+		{"0", addrID},
+		{"dev", addrName},
+		{"0ff", addrName}, // Ведущий ноль потеряется при обратном преобразовании
+		{"FF", addrName},  // Идентификаторы передаются в нижнем регистре
+		{"", addrName},
+		{"10000000000000000", addrName}, // Больше uint64
+	}
+	for _, c := range cases {
+		res := appendAddr(nil, c.addr)
+		if res[0] != c.addrType {
+			t.Errorf("Address %q has type %d, expected %d", c.addr, res[0], c.addrType)
+		}
+		r := binaryReader{data: res}
+		if addr, err := r.addr(); err != nil || addr != c.addr {
+			t.Errorf("Address %q is read as %q, %v", c.addr, addr, err)
+		}
+		if r.pos != len(res) {
+			t.Errorf("Address %q read %d bytes of %d", c.addr, r.pos, len(res))
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	cases := []dto.Message{
+		{ID: 1, Command: dto.DataCOMMAND, Jmp: 2, From: "1000000000000001", To: "1000000000000002", Content: []byte("data")},
+		{ID: 1 << 40, Command: dto.ConnectByNameCOMMAND, Jmp: 300, From: "dev", To: "Controller", Content: []byte{}},
+		{Command: dto.RegisterCOMMAND, Jmp: 1, From: "0ab", To: "0", Content: bytes.Repeat([]byte{0, '$', 'V', 2}, 100)},
+		{Command: dto.PingCOMMAND, Jmp: 1, From: "", To: "AB"},
+	}
+	for _, msg := range cases {
+		data, err := CreateEmptyParser(1 << 20).FormMessage(dto.Message{
+			ID: msg.ID, Command: msg.Command, Jmp: msg.Jmp, Proto: binaryProtocolVersion, From: msg.From, To: msg.To, Content: msg.Content,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[2] != binaryProtocolVersion {
+			t.Fatalf("Message %v is not binary % x", msg, data)
+		}
+		p := CreateEmptyParser(1 << 20)
+		res, err := p.ParseMessage(data)
+		if err != nil {
+			t.Fatalf("Message %v parse error %v", msg, err)
+		}
+		if res.ID != msg.ID || res.Command != msg.Command || res.Jmp != msg.Jmp-1 || res.Proto != binaryProtocolVersion ||
+			res.From != msg.From || res.To != msg.To || !bytes.Equal(res.Content, msg.Content) {
+			t.Errorf("Message %v is parsed as %v", msg, res)
+		}
+		answer, _ := p.FormMessage(dto.Message{Command: dto.ErrorCOMMAND, Jmp: 1, Proto: 1, From: "0", To: msg.From})
+		if answer[2] != binaryProtocolVersion {
+			t.Errorf("Answer to binary message must be binary % x", answer)
+		}
+	}
+}
+
+func TestBinaryHeaderErrors(t *testing.T) {
+	valid := formBinaryMessage(dto.Message{ID: 5, Command: dto.DataCOMMAND, Jmp: 1, From: "a", To: "b", Content: []byte("x")})
+	cases := []struct {
+		name  string
+		data  []byte
+		short bool // Заголовок не полный, а не ошибочный
+	}{
+		{"short", valid[:minBinaryHeaderSize-1], true},
+		{"cut address", formBinaryMessage(dto.Message{Command: dto.DataCOMMAND, Jmp: 1, From: "long client name", To: "b"})[:14], true},
+		{"zero jump", formBinaryMessage(dto.Message{ID: 5, Command: dto.DataCOMMAND, From: "a", To: "b"}), false},
+		{"bad address type", append(append([]byte{}, valid[:6]...), 7, 0, 0, 0, 0), false},
+		{"too long address", append(append([]byte("$V\x02\x09\x01\x00\x01"), appendUvarint(nil, maxHeaderSize+1)...), make([]byte, 8)...), false},
+		{"too big content", formBinaryMessage(dto.Message{Command: dto.DataCOMMAND, Jmp: 1, Content: make([]byte, 2048)}), false},
+	}
+	for _, c := range cases {
+		p := CreateEmptyParser(1024).(*C2cParser)
+		_, err := p.parseHeader(c.data)
+		if err == nil || (err == errShortHeader) != c.short {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+	}
+}
+
+func TestParseResetsHeader(t *testing.T) {
+	p := CreateEmptyParser(1024)
+	// Идентификатор разобран, но сообщение отклонено из-за счетчика прыжков
+	if _, err := p.ParseMessage(formBinaryMessage(dto.Message{ID: 77, Command: dto.DataCOMMAND, From: "a", To: "b"})); err == nil {
+		t.Fatal("Message with zero jump count is parsed")
+	}
+	if _, err := p.ParseMessage([]byte("$V1;a;b;9;1;A###short")); err == nil {
+		t.Fatal("Not full message is parsed")
+	}
+	res, err := p.ParseMessage([]byte("$V1;a;b;9;2;4###data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != 0 || res.Proto != 1 || res.Jmp != 1 || string(res.Content) != "data" {
+		t.Errorf("Message is parsed with stale header %v", res)
+	}
+}
@@ -1,12 +1,16 @@
 package parser
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 
 	"github.com/blabu/egeonC2cService/dto"
+	"github.com/blabu/egeonC2cService/metrics"
+	"go.uber.org/atomic"
 )
 
 // *Протокол.
@@ -24,9 +28,14 @@ import (
 // *### - Конец заголовка
 // *
 // *Пример: $V1;987654321;12345678;5;2;C###MESSAGE DATA
+// *
+// *Компактная бинарная версия протокола описана в c2cBinary.go
 
 const headerParamSize = 6
 
+// maxHeaderSize - максимально допустимый размер заголовка
+const maxHeaderSize = 256
+
 var beginHeader = []byte("$V")
 var endHeader = []byte("###")
 var delim = []byte(";")
@@ -35,6 +44,7 @@ type header struct {
 	protocolVer uint64 // Версия протокола
 	mType       uint64 // Тип сообщения (смотри клиента)
 	jumpCnt     uint64 // счетчик прыжков
+	id          uint64 // идентификатор сообщения (только в бинарной версии)
 
 	headerSize  int // Размер заголовка
 	contentSize int // Размер данных
@@ -44,10 +54,12 @@ type header struct {
 }
 
 // C2cParser - Парсер разбирает сообщения по протоколу
-// 1 - клиент-клиент
+// 1 - клиент-клиент (текстовый заголовок)
+// 2 - клиент-клиент (бинарный заголовок)
 type C2cParser struct {
 	maxPackageSize uint64
 	head           header
+	version        atomic.Uint32 // Версия протокола последнего принятого сообщения, в ней же формируются ответы
 }
 
 //CreateEmptyParser - создает интерфейс парсера с ограничением максимального размера сообщения maxSize
@@ -59,10 +71,18 @@ func CreateEmptyParser(maxSize uint64) Parser {
 }
 
 //FormMessage - from - Content[0], to - Content[1], data - Content[2]
+// Если от клиента уже было принято сообщение, ответ формируется в той же версии протокола
 func (c2c *C2cParser) FormMessage(msg dto.Message) ([]byte, error) {
+	ver := uint64(msg.Proto)
+	if v := c2c.version.Load(); v != 0 {
+		ver = uint64(v)
+	}
+	if ver == binaryProtocolVersion {
+		return formBinaryMessage(msg), nil
+	}
 	res := make([]byte, 0, 128+len(msg.Content))
 	res = append(res, beginHeader...)
-	res = append(res, []byte(strconv.FormatUint(uint64(msg.Proto), 16))...)
+	res = append(res, []byte(strconv.FormatUint(ver, 16))...)
 	res = append(res, ';')
 	res = append(res, msg.From...)
 	res = append(res, ';')
@@ -79,22 +99,40 @@ func (c2c *C2cParser) FormMessage(msg dto.Message) ([]byte, error) {
 }
 
 // return position for start header or/and error if not find header or parsing error
+// headerSize is counted from the start position
 func (c2c *C2cParser) parseHeader(data []byte) (int, error) {
-	if data == nil || len(data) < c2c.GetMinimumDataSize() {
+	c2c.head = header{} // Поля прошлой попытки разбора не должны попасть в новое сообщение
+	if len(data) == 0 {
 		return 0, errors.New("Input is empty, nothing to be parsed")
 	}
 	index := bytes.IndexByte(data, '$')
 	if index < 0 {
 		return 0, fmt.Errorf("Undefined start symb of package %s", string(data))
 	}
+	if len(data)-index <= len(beginHeader) {
+		return index, errShortHeader
+	}
 	if !bytes.EqualFold(data[index:index+2], beginHeader) {
 		return index, fmt.Errorf("Package must be started from %s", beginHeader)
 	}
-	c2c.head.headerSize = bytes.Index(data, []byte(endHeader)) // Поиск конца заголовка
-	if c2c.head.headerSize < index || c2c.head.headerSize >= len(data) {
+	if data[index+len(beginHeader)] == binaryProtocolVersion {
+		if len(data)-index < minBinaryHeaderSize {
+			return index, errShortHeader
+		}
+		return index, c2c.parseBinaryHeader(data[index:])
+	}
+	if len(data)-index < c2c.GetMinimumDataSize() {
+		return index, errShortHeader
+	}
+	end := bytes.Index(data, []byte(endHeader)) // Поиск конца заголовка
+	if end < index || end >= len(data) {
+		if len(data)-index < maxHeaderSize {
+			return index, errShortHeader
+		}
 		return index, fmt.Errorf("Undefined end header %s in message %s", endHeader, string(data))
 	}
-	parsed := bytes.Split(data[index+2:c2c.head.headerSize], delim)
+	c2c.head.headerSize = end - index
+	parsed := bytes.Split(data[index+2:end], delim)
 	if len(parsed) < headerParamSize {
 		return index, errors.New("Incorrect header")
 	}
@@ -125,7 +163,8 @@ func (c2c *C2cParser) parseHeader(data []byte) (int, error) {
 		c2c.head.contentSize = int(s)
 		c2c.head.headerSize += len(endHeader) // Add endHeader
 		return index, nil
-		// TODO implement another version of protocol
+	case binaryProtocolVersion:
+		return index, errors.New("Protocol version 2 must be sent with binary header")
 	default:
 		return index, errors.New("Error usuported porotocol")
 	}
@@ -133,6 +172,9 @@ func (c2c *C2cParser) parseHeader(data []byte) (int, error) {
 
 //ParseMessage - from - Content[0], to - Content[1], data - Content[2]
 func (c2c *C2cParser) ParseMessage(data []byte) (dto.Message, error) {
+	defer func() {
+		c2c.head = header{}
+	}()
 	var err error
 	var i int
 	if i, err = c2c.parseHeader(data); err != nil {
@@ -141,35 +183,91 @@ func (c2c *C2cParser) ParseMessage(data []byte) (dto.Message, error) {
 	if len(data) < i+c2c.head.headerSize+c2c.head.contentSize {
 		return dto.Message{}, errors.New("Not full message")
 	}
+	content := make([]byte, c2c.head.contentSize)
+	copy(content, data[i+c2c.head.headerSize:i+c2c.head.headerSize+c2c.head.contentSize])
+	return c2c.message(content), nil
+}
+
+// ReadMessage - читает из потока ровно один пакет.
+// Заголовок разбирается один раз, как только он получен полностью (обычно за один проход по уже прочитанным данным).
+// Все байты после пакета остаются в буфере r и будут разобраны следующим вызовом
+func (c2c *C2cParser) ReadMessage(r *bufio.Reader) (dto.Message, error) {
 	defer func() {
 		c2c.head = header{}
 	}()
-	c2c.head.jumpCnt--
+	if err := skipToHeader(r); err != nil {
+		return dto.Message{}, err
+	}
+	size := len(beginHeader) + 1
+	for {
+		if b := r.Buffered(); b > size {
+			size = b
+		}
+		if size > maxHeaderSize {
+			size = maxHeaderSize
+		}
+		data, err := r.Peek(size) // Ждем пока не придет хотя бы size байт
+		if err != nil {
+			return dto.Message{}, err
+		}
+		if _, err = c2c.parseHeader(data); err == nil {
+			break
+		}
+		if err != errShortHeader {
+			metrics.ParseErrors.Inc()
+			return dto.Message{}, err
+		}
+		if size == maxHeaderSize {
+			metrics.ParseErrors.Inc()
+			return dto.Message{}, fmt.Errorf("Header is bigger than %d bytes", maxHeaderSize)
+		}
+		size++
+	}
+	if _, err := r.Discard(c2c.head.headerSize); err != nil {
+		return dto.Message{}, err
+	}
 	content := make([]byte, c2c.head.contentSize)
-	copy(content, data[i+c2c.head.headerSize:i+c2c.head.headerSize+c2c.head.contentSize])
+	if _, err := io.ReadFull(r, content); err != nil {
+		return dto.Message{}, err
+	}
+	return c2c.message(content), nil
+}
+
+// skipToHeader - пропускает мусор перед началом заголовка
+func skipToHeader(r *bufio.Reader) error {
+	for skipped := 0; ; skipped++ {
+		b, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == startSymb {
+			return nil
+		}
+		if skipped >= maxHeaderSize {
+			metrics.ParseErrors.Inc()
+			return errors.New("Undefined start symb of package")
+		}
+		r.Discard(1)
+	}
+}
+
+// message - формирует сообщение из разобранного заголовка и данных
+func (c2c *C2cParser) message(content []byte) dto.Message {
+	c2c.head.jumpCnt--
+	c2c.version.Store(uint32(c2c.head.protocolVer))
 	return dto.Message{
+		ID:      c2c.head.id,
 		Command: uint16(c2c.head.mType),
 		Proto:   uint16(c2c.head.protocolVer),
 		Jmp:     uint16(c2c.head.jumpCnt),
 		From:    c2c.head.from,
 		To:      c2c.head.to,
 		Content: content,
-	}, nil
-}
-
-// IsFullReceiveMsg - Проверка пришел полный пакет или нет
-// TODO каждый раз парсить заголовок не эффективно надо будет переписать
-func (c2c *C2cParser) IsFullReceiveMsg(data []byte) (int, error) {
-	if _, err := c2c.parseHeader(data); err != nil {
-		return -1, err
-	}
-	if len(data) >= c2c.head.contentSize+c2c.head.headerSize {
-		return 0, nil
 	}
-	return c2c.head.contentSize + c2c.head.headerSize - len(data), nil
 }
 
 //GetMinimumDataSize - вернт минимальный валидный пакет в рамках протокола c2c
+// (поля от кого и кому могут быть пустыми, остальные содержат хотя бы один символ)
 func (c2c *C2cParser) GetMinimumDataSize() int {
-	return len(beginHeader) + headerParamSize*(len(delim)+1) + len(endHeader)
+	return len(beginHeader) + (headerParamSize - 2) + (headerParamSize-1)*len(delim) + len(endHeader)
 }
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/blabu/egeonC2cService/dto"
+)
+
+// frame - пакет в версии протокола proto
+func frame(proto uint16, msg dto.Message) []byte {
+	msg.Proto = proto
+	res, _ := CreateEmptyParser(1 << 20).FormMessage(msg)
+	return res
+}
+
+var streamMessages = []dto.Message{
+	{Command: dto.InitByNameCOMMAND, Jmp: 2, Proto: 1, From: "dev", To: "0", Content: []byte("nonce;proof")},
+	{ID: 9, Command: dto.DataCOMMAND, Jmp: 3, Proto: binaryProtocolVersion, From: "1000000000000001", To: "peer", Content: []byte("$V1;a;b;9;1;0###")},
+	{Command: dto.PingCOMMAND, Jmp: 1, Proto: 1, From: "dev", To: "0"},
+	{ID: 10, Command: dto.SaveDataCOMMAND, Jmp: 1, Proto: binaryProtocolVersion, From: "dev", To: "ff", Content: bytes.Repeat([]byte("data"), 300)},
+}
+
+// stream - v1 и v2 пакеты вперемешку в одном потоке
+func stream() []byte {
+	var res []byte
+	for _, m := range streamMessages {
+		res = append(res, frame(m.Proto, m)...)
+	}
+	return res
+}
+
+func TestReadMessageStream(t *testing.T) {
+	cases := []struct {
+		name   string
+		reader func(data []byte) io.Reader
+	}{
+		{"one read", func(data []byte) io.Reader { return bytes.NewReader(data) }},
+		{"byte by byte", func(data []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(data)) }},
+		{"half reads", func(data []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(data)) }},
+		{"garbage before header", func(data []byte) io.Reader {
+			return io.MultiReader(strings.NewReader("garbage\r\n"), bytes.NewReader(data))
+		}},
+	}
+	for _, c := range cases {
+		p := CreateEmptyParser(1 << 20)
+		r := bufio.NewReader(c.reader(stream()))
+		for i, msg := range streamMessages {
+			res, err := p.ReadMessage(r)
+			if err != nil {
+				t.Fatalf("%s: message %d read error %v", c.name, i, err)
+			}
+			if res.ID != msg.ID || res.Command != msg.Command || res.Jmp != msg.Jmp-1 || res.Proto != msg.Proto ||
+				res.From != msg.From || res.To != msg.To || !bytes.Equal(res.Content, msg.Content) {
+				t.Errorf("%s: message %v is read as %v", c.name, msg, res)
+			}
+		}
+		if _, err := p.ReadMessage(r); err != io.EOF {
+			t.Errorf("%s: expected EOF after all messages, got %v", c.name, err)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"oversize header", "$V1;" + strings.Repeat("a", maxHeaderSize) + ";b;9;1;0###"},
+		{"only garbage", strings.Repeat("x", maxHeaderSize+1)},
+		{"incorrect header", "$V1;a;b;z;1;0###"},
+		{"zero jump", "$V1;a;b;9;0;0###"},
+		{"too big content", "$V1;a;b;9;1;FFFF###"},
+		{"cut content", "$V1;a;b;9;1;A###data"},
+	}
+	for _, c := range cases {
+		p := CreateEmptyParser(1024)
+		if res, err := p.ReadMessage(bufio.NewReader(strings.NewReader(c.data))); err == nil {
+			t.Errorf("%s: message is read %v", c.name, res)
+		}
+	}
+}
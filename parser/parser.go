@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"bufio"
+
 	"github.com/blabu/egeonC2cService/dto"
 )
 
@@ -11,6 +13,6 @@ import (
 type Parser interface {
 	FormMessage(msg dto.Message) ([]byte, error)
 	ParseMessage(data []byte) (dto.Message, error)
-	IsFullReceiveMsg(data []byte) (int, error)
+	ReadMessage(r *bufio.Reader) (dto.Message, error) // Читает из потока один пакет, остаток данных остается в r
 	GetMinimumDataSize() int // Минимально возможный осмысленный пакет в рамках протокола
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/blabu/egeonC2cService/client/c2cService"
+	cf "github.com/blabu/egeonC2cService/configuration"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+// tlsCertificates - сертификат сервера и центры сертификации клиентов. Перечитываются по SIGHUP,
+// новые TLS соединения сразу используют новые сертификаты, открытые сессии не разрываются
+type tlsCertificates struct {
+	cert   *tls.Certificate
+	client *tls.Config // Настройки рукопожатия: текущий сертификат и проверка сертификатов клиентов
+	mtx    sync.RWMutex
+}
+
+var certificates tlsCertificates
+
+// load - читает сертификаты по путям из конфигурации, при ошибке остаются прежние
+func (t *tlsCertificates) load() error {
+	certPath, privateKeyPath := cf.Get().CertificatePath, cf.Get().PrivateKeyPath
+	if len(certPath) == 0 {
+		return errors.New("Undefine certificate path")
+	}
+	if len(privateKeyPath) == 0 {
+		return errors.New("Undefine private key path")
+	}
+	certificate, err := tls.LoadX509KeyPair(certPath, privateKeyPath)
+	if err != nil {
+		return err
+	}
+	conf := &tls.Config{GetCertificate: t.getCertificate}
+	if err = setClientCA(conf); err != nil {
+		return err
+	}
+	t.mtx.Lock()
+	t.cert = &certificate
+	t.client = conf
+	t.mtx.Unlock()
+	return nil
+}
+
+// loaded - true если сертификаты уже загружены и используются TLS слушателями
+func (t *tlsCertificates) loaded() bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.cert != nil
+}
+
+func (t *tlsCertificates) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.cert, nil
+}
+
+func (t *tlsCertificates) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.client, nil
+}
+
+// reloadConfig - перечитывает файл конфигурации и сертификаты по SIGHUP, открытые сессии продолжают работать.
+// Новые значения таймаутов, длины очередей и ограничений действуют для новых сессий и запросов,
+// соединения с соседями из PeerServers открываются и закрываются сразу
+func reloadConfig() {
+	log.Infof("Reload configuration file %s", *confPath)
+	old := cf.Get()
+	changed, ignored, err := cf.Reload(*confPath)
+	if err != nil {
+		log.Errorf("Can not reload configuration file %s, old configuration is used %v", *confPath, err)
+		return
+	}
+	if len(ignored) != 0 {
+		log.Warningf("Settings %s can not be reloaded, they will be applied after restart", strings.Join(ignored, ", "))
+	}
+	if len(changed) != 0 {
+		log.Infof("Settings %s are reloaded", strings.Join(changed, ", "))
+	}
+	if old.LogPath != cf.Get().LogPath || old.SaveDuration != cf.Get().SaveDuration {
+		log.GetLogger().SetFile(logSettings())
+	}
+	if !reflect.DeepEqual(old.PeerServers, cf.Get().PeerServers) {
+		c2cService.UpdatePeers()
+	}
+	if certificates.loaded() {
+		if err = certificates.load(); err != nil {
+			log.Errorf("Can not reload TLS certificates, old certificates are used %v", err)
+		} else {
+			log.Info("TLS certificates are reloaded")
+		}
+	}
+}
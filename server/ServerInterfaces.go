@@ -32,5 +32,7 @@ type ClientReader interface {
 // MainLogicIO - основоной интерфейс логики взаимодействия сервера с логикой приложения
 type MainLogicIO interface {
 	ClientReader
-	io.WriteCloser
+	// Write - передает разобранное сообщение из сети в клиентскую логику
+	Write(msg *dto.Message) error
+	io.Closer
 }
@@ -6,7 +6,6 @@ import (
 
 	"github.com/blabu/egeonC2cService/parser"
 
-	conf "github.com/blabu/egeonC2cService/configuration"
 	log "github.com/blabu/egeonC2cService/logWrapper"
 
 	"bufio"
@@ -19,7 +18,7 @@ import (
 type BidirectSession struct {
 	Tm       *time.Timer
 	Duration time.Duration
-	netReq   []byte
+	reader   *bufio.Reader // Буфер соединения, хранит принятые но еще не разобранные байты
 	logic    MainLogicIO
 }
 
@@ -30,7 +29,8 @@ func (c *BidirectSession) updateWatchDogTimer() {
 }
 
 //readHandler - Поток для чтения данных из интернета (всегда ждем данных),
-// проверяем полное ли сообщение, если полное, отправляем дальше
+// парсер выделяет из потока полные сообщения, которые передаем дальше.
+// Несколько сообщений, пришедших одним сегментом, разбираются по очереди из буфера
 func (c *BidirectSession) readHandler(
 	Connect *net.Conn,
 	stopConnectionFromNet <-chan bool,
@@ -38,8 +38,6 @@ func (c *BidirectSession) readHandler(
 	p parser.Parser) {
 
 	defer close(stopConnectionFromClient)
-	maxPacketSize := uint64(conf.Config.MaxPacketSize) * 1024
-	bufferdReader := bufio.NewReader(*Connect)
 	for {
 		select {
 		case <-stopConnectionFromNet:
@@ -47,39 +45,16 @@ func (c *BidirectSession) readHandler(
 			return
 		default:
 			c.updateWatchDogTimer()
-			leftBytes, err := p.IsFullReceiveMsg(c.netReq)
-			if err != nil {
-				log.Warning(err.Error())
-				return
-			}
-			if uint64(leftBytes+len(c.netReq)) > maxPacketSize {
-				log.Errorf("Message %s is to big %d and max %d", string(c.netReq), leftBytes+len(c.netReq), maxPacketSize)
-				return
-			}
-			if leftBytes == 0 { // Если все байты получены
-				if _, err := c.logic.Write(c.netReq); err != nil {
-					log.Warning(err.Error())
-					return // TODO Выполнять обработку ошибок
-				}
-				c.netReq = c.netReq[:minHeaderSize]
-				(*Connect).SetReadDeadline(time.Now().Add(c.Duration))
-				numb, err := bufferdReader.Read(c.netReq) // Читаем!!!
-				if err != nil {
-					log.Infof("Error when try read from conection: %v", err)
-					return
-				}
-				c.netReq = c.netReq[:numb]
-				continue
-			}
-			log.Tracef("Try read last %d bytes", leftBytes)
-			temp := make([]byte, leftBytes)
 			(*Connect).SetReadDeadline(time.Now().Add(c.Duration))
-			leftBytes, err = io.ReadFull(bufferdReader, temp) // Читаем остальное!!!
+			m, err := p.ReadMessage(c.reader) // Читаем!!!
 			if err != nil {
 				log.Infof("Error when try read from conection: %v", err)
 				return
 			}
-			c.netReq = append(c.netReq, temp[:leftBytes]...) // Добавляем к сообщению прочтенное
+			if err := c.logic.Write(&m); err != nil {
+				log.Warning(err.Error())
+				return // TODO Выполнять обработку ошибок
+			}
 		}
 	}
 }
@@ -91,15 +66,16 @@ func (c *BidirectSession) readHandler(
 func (c *BidirectSession) Run(Connect net.Conn, p parser.Parser) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	writer := newSessionWriter(Connect)
+	go writer.run(ctx)
 	go c.logic.Read(ctx, func(data []byte, systemError error) error { //Читаем из системы пишем в интернет
 		if data != nil && systemError == nil {
 			c.updateWatchDogTimer()
-			Connect.SetWriteDeadline(time.Now().Add(time.Duration(len(data)) * 10 * time.Millisecond))
-			_, err := Connect.Write(data)
+			_, err := writer.Write(data)
 			return err
-		} else if systemError == io.EOF { //Если ошибка из системы это конец потока. Закрываем соединение
+		} else if systemError == io.EOF { //Если ошибка из системы это конец потока. Дописываем все и закрываем соединение
 			log.Info("Close connection by read operation")
-			return Connect.Close()
+			return writer.Close()
 		}
 		return nil
 	})
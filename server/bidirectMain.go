@@ -5,49 +5,110 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	conf "github.com/blabu/egeonC2cService/configuration"
 	log "github.com/blabu/egeonC2cService/logWrapper"
 
 	"github.com/blabu/egeonC2cService/client"
 	"github.com/blabu/egeonC2cService/clientFactory"
 	"github.com/blabu/egeonC2cService/dto"
+	"github.com/blabu/egeonC2cService/metrics"
 	"github.com/blabu/egeonC2cService/parser"
 )
 
+// errorsWindow - промежуток времени в котором считаются ошибочные запросы клиента
+const errorsWindow = time.Minute
+
 // bidirectMain - двунаправленная реализация MainLogicIO для независимого чтения и записи информации
 // Реализовано:
 // 1. чтение с клиента и запись в сеть метод Read()
 // 2. запись в клиента метод Write()
+// 3. ответ клиенту сообщением об ошибке, если клиентская логика не смогла обработать его запрос
 type bidirectMain struct {
-	sessionID uint32
-	p         parser.Parser
-	c         client.ReadWriteCloser
+	sessionID   uint32
+	p           parser.Parser
+	c           client.ReadWriteCloser
+	replies     chan dto.Message // Ответы с ошибками, отправляются клиенту наравне с сообщениями клиентской логики
+	handlerMtx  sync.Mutex       // Сообщения в сеть отправляются только по одному
+	errorsCnt   uint16           // Количество ошибочных запросов в текущем окне
+	errorsStart time.Time        // Начало текущего окна подсчета ошибок
 }
 
 //CreateReadWriteMainLogic - Создаем новый интерфейс для MainLogicIO (логики взаимодействия сервера и клиентской логики)
 //!!!НИКОГДА НЕ ВОЗРАЩАЕТ NIL!!!
-func CreateReadWriteMainLogic(p parser.Parser, readTimeout time.Duration) MainLogicIO {
+func CreateReadWriteMainLogic(p parser.Parser, readTimeout time.Duration, remoteAddr string, certNames []string) MainLogicIO {
 	sesID := atomic.AddUint32(&lastSessionID, 1)
 	return &bidirectMain{
 		sessionID: sesID,
 		p:         p,
-		c:         clientFactory.CreateClientLogic(p, sesID),
+		c:         clientFactory.CreateClientLogic(p, sesID, remoteAddr, certNames),
+		replies:   make(chan dto.Message, conf.DefaultMaxClientErrors),
 	}
 }
 
-// Write - синхронный вызов парсит сообщение полученное с сети и пишет данные в клиентскую логику
-func (s *bidirectMain) Write(data []byte) (int, error) {
+// Write - синхронный вызов пишет разобранное сообщение полученное с сети в клиентскую логику
+func (s *bidirectMain) Write(msg *dto.Message) error {
 	if s.c == nil {
-		return 0, errors.New("Nil error")
+		return errors.New("Nil error")
+	}
+	metrics.Messages.With(commandLabel(msg.Command)).Inc()
+	if err := s.c.Write(msg); err != nil {
+		return s.replyError(msg, err)
+	}
+	return nil
+}
+
+// commandLabel - метка команды для метрики Messages. Неизвестные команды учитываются под одной меткой other,
+// иначе клиент может создать сколько угодно рядов метрики
+func commandLabel(cmd uint16) string {
+	if cmd < dto.ErrorCOMMAND || cmd > dto.ShutdownCOMMAND {
+		return "other"
+	}
+	return strconv.FormatUint(uint64(cmd), 10)
+}
+
+// replyError - сообщает клиенту про ошибку обработки его запроса ответом ErrorCOMMAND.
+// Вернет ошибку (соединение будет разорвано) только если ошибка системная,
+// не известна клиентской логике или клиент ошибается слишком часто
+func (s *bidirectMain) replyError(msg *dto.Message, err error) error {
+	clientErr, ok := err.(client.ClientError)
+	if !ok {
+		return err
 	}
-	m, err := s.p.ParseMessage(data)
-	if err != nil {
-		log.Warningf("Can not parse message in session %d. Error %s", s.sessionID, err.Error())
-		return 0, err
+	select {
+	case s.replies <- client.ErrorMessage(msg, clientErr.Code(), clientErr.Error()):
+	default:
+		log.Warningf("Error replies queue is full in session %d", s.sessionID)
 	}
-	return len(data), s.c.Write(&m)
+	if clientErr.IsCritical() {
+		return err
+	}
+	if time.Since(s.errorsStart) > errorsWindow {
+		s.errorsStart = time.Now()
+		s.errorsCnt = 0
+	}
+	s.errorsCnt++
+	maxErrors := conf.Get().MaxClientErrors
+	if maxErrors == 0 {
+		maxErrors = conf.DefaultMaxClientErrors
+	}
+	if s.errorsCnt > maxErrors {
+		return fmt.Errorf("Too many errors %d in session %d, last one %s", s.errorsCnt, s.sessionID, err.Error())
+	}
+	log.Infof("Send error %d to client in session %d: %s", clientErr.Code(), s.sessionID, err.Error())
+	return nil
+}
+
+// send - формирует и передает сообщение обработчику handler.
+// Сообщения клиентской логики и ответы с ошибками отправляются из разных потоков
+func (s *bidirectMain) send(handler dto.ServerReadHandler, msg dto.Message) error {
+	s.handlerMtx.Lock()
+	defer s.handlerMtx.Unlock()
+	return handler(s.p.FormMessage(msg))
 }
 
 //Read - читает из системы и передает данные обработчику handler
@@ -56,6 +117,19 @@ func (s *bidirectMain) Read(ctx context.Context, handler dto.ServerReadHandler)
 		handler(nil, errors.New("Parser or client is nil"))
 		return
 	}
+	go func() {
+		for {
+			select {
+			case m := <-s.replies:
+				if err := s.send(handler, m); err != nil {
+					log.Warningf("Can not send error reply in session %d %v", s.sessionID, err)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	s.c.Read(ctx, func(msg dto.Message, systemError error) error {
 		if systemError != nil {
 			if systemError == io.EOF { // Читать больше нечего
@@ -65,7 +139,7 @@ func (s *bidirectMain) Read(ctx context.Context, handler dto.ServerReadHandler)
 			return systemError
 		}
 		log.Trace("Received data from client logic fine")
-		return handler(s.p.FormMessage(msg)) //Передаем данные для отправки в интернет
+		return s.send(handler, msg) //Передаем данные для отправки в интернет
 	})
 }
 
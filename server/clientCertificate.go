@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/blabu/egeonC2cService/configuration"
+)
+
+// Откуда брать имя клиента в сертификате (ClientCertName)
+const (
+	certNameCN  = "cn"  // Только Subject Common Name (по умолчанию)
+	certNameSAN = "san" // Только Subject Alternative Name: DNS имена, email и URI
+	certNameAny = "any" // И CN и SAN
+)
+
+// clientCertNames - имена из проверенного при TLS рукопожатии сертификата клиента.
+// Вернет nil если соединение не TLS или клиент не предъявил сертификат
+func clientCertNames(conn net.Conn) []string {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.ws.UnderlyingConn()
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	mode := strings.ToLower(configuration.Get().ClientCertName)
+	var res []string
+	if mode != certNameSAN && len(cert.Subject.CommonName) != 0 {
+		res = append(res, cert.Subject.CommonName)
+	}
+	if mode == certNameSAN || mode == certNameAny {
+		res = append(res, cert.DNSNames...)
+		res = append(res, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			res = append(res, uri.String())
+		}
+	}
+	return res
+}
@@ -33,9 +33,9 @@ func (p panicCover) Read(ctx context.Context, handler dto.ServerReadHandler) {
 	})
 }
 
-func (p panicCover) Write(data []byte) (int, error) {
+func (p panicCover) Write(msg *dto.Message) error {
 	defer p.cover()
-	return p.base.Write(data)
+	return p.base.Write(msg)
 }
 
 func (p panicCover) Close() error {
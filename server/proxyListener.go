@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/blabu/egeonC2cService/logWrapper"
+)
+
+const proxyHeaderTimeOut = 5 * time.Second // Время ожидания заголовка PROXY протокола
+
+const proxyV1MaxSize = 107 // Максимальная длина заголовка первой версии вместе с \r\n
+
+var proxyV1Signature = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener - реализация net.Listener для соединений через балансировщик с PROXY протоколом v1 или v2.
+// Адрес клиента из заголовка принимается только от доверенных адресов, соединения от остальных адресов
+// и соединения без заголовка передаются как есть, с реальным адресом отправителя
+type proxyListener struct {
+	base    net.Listener
+	trusted []*net.IPNet
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewProxyListener - разбирает заголовки PROXY протокола в соединениях от адресов или подсетей trusted
+func NewProxyListener(listen net.Listener, trusted []string) (net.Listener, error) {
+	l := &proxyListener{
+		base:  listen,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	for _, val := range trusted {
+		if !strings.Contains(val, "/") {
+			if ip := net.ParseIP(val); ip != nil && ip.To4() != nil {
+				val += "/32"
+			} else {
+				val += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(val)
+		if err != nil {
+			return nil, fmt.Errorf("Incorrect trusted proxy address %s", val)
+		}
+		l.trusted = append(l.trusted, network)
+	}
+	if len(l.trusted) == 0 {
+		log.Warningf("There are no trusted proxies for %s, PROXY protocol headers will be ignored", listen.Addr())
+	}
+	go l.serve()
+	return l, nil
+}
+
+func (l *proxyListener) serve() {
+	defer l.Close()
+	for {
+		conn, err := l.base.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				log.Warningf("Temporary Accept() failure - %s", err)
+				continue
+			}
+			log.Infof("Proxy listener %s is finished %v", l.base.Addr(), err)
+			return
+		}
+		go l.accept(conn)
+	}
+}
+
+// accept - читает заголовок PROXY протокола и передает соединение в Accept
+func (l *proxyListener) accept(conn net.Conn) {
+	if l.isTrusted(conn.RemoteAddr()) {
+		p := &proxyConn{Conn: conn, reader: bufio.NewReaderSize(conn, proxyV1MaxSize+1)}
+		conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeOut))
+		err := p.readHeader()
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Warningf("Incorrect PROXY protocol header from %s %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = p
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept - ждет следующее соединение с уже разобранным заголовком
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("Proxy listener is closed")
+	}
+}
+
+// Close - перестает принимать соединения, уже принятые соединения продолжают работать
+func (l *proxyListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.base.Close()
+	})
+	return err
+}
+
+func (l *proxyListener) Addr() net.Addr {
+	return l.base.Addr()
+}
+
+// proxyConn - соединение через балансировщик, RemoteAddr вернет адрес клиента из заголовка PROXY протокола
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader // Данные после заголовка
+	remote net.Addr      // Адрес клиента, nil если балансировщик его не передал
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader - разбирает заголовок PROXY протокола, если он есть
+func (c *proxyConn) readHeader() error {
+	sign, err := c.reader.Peek(len(proxyV1Signature))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(sign, proxyV1Signature) {
+		return c.readV1()
+	}
+	if sign[0] != proxyV2Signature[0] {
+		return nil // Соединение без заголовка
+	}
+	if sign, err = c.reader.Peek(len(proxyV2Signature)); err != nil {
+		return err
+	}
+	if bytes.Equal(sign, proxyV2Signature) {
+		return c.readV2()
+	}
+	return nil
+}
+
+// readV1 - PROXY TCP4|TCP6 адрес_клиента адрес_сервера порт_клиента порт_сервера\r\n или PROXY UNKNOWN ...\r\n
+func (c *proxyConn) readV1() error {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) > proxyV1MaxSize || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("Header v1 is too long or incorrect")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("Incorrect header v1 %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return fmt.Errorf("Incorrect client address in header v1 %q", line)
+	}
+	c.remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+// readV2 - двоичный заголовок: подпись, версия и команда, семейство адресов, длина адресов и сами адреса
+func (c *proxyConn) readV2() error {
+	head := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return err
+	}
+	verCmd, family := head[12], head[13]
+	addr := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(c.reader, addr); err != nil {
+		return err
+	}
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("Unsupported version %d", verCmd>>4)
+	}
+	if verCmd&0x0F == 0 { // LOCAL - соединение самого балансировщика
+		return nil
+	}
+	switch family >> 4 {
+	case 1: // IPv4: адрес клиента, адрес сервера, порт клиента, порт сервера
+		if len(addr) < 12 {
+			return errors.New("Short IPv4 address in header v2")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(addr[:4]), Port: int(binary.BigEndian.Uint16(addr[8:]))}
+	case 2: // IPv6
+		if len(addr) < 36 {
+			return errors.New("Short IPv6 address in header v2")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(addr[:16]), Port: int(binary.BigEndian.Uint16(addr[32:]))}
+	}
+	return nil
+}
@@ -1,26 +1,100 @@
 package server
 
 import (
+	"bufio"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blabu/egeonC2cService/configuration"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+	"github.com/blabu/egeonC2cService/metrics"
 	"github.com/blabu/egeonC2cService/parser"
 )
 
-const minHeaderSize = 128
+var activeSessions int32 // Количество открытых сессий
 
-// StartNewSession - инициализирует все и стартует сессию
-func StartNewSession(conn net.Conn, dT time.Duration) {
-	req := make([]byte, minHeaderSize)
+// connList - соединения открытых сессий, чтобы закрыть их при остановке сервера
+type connList struct {
+	list map[net.Conn]struct{}
+	mtx  sync.Mutex
+}
+
+var conns = connList{list: make(map[net.Conn]struct{})}
+
+func (c *connList) add(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.list[conn] = struct{}{}
+}
+
+func (c *connList) del(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.list, conn)
+}
+
+// CloseSessions - принудительно закрывает соединения всех открытых сессий, вернет количество закрытых соединений.
+// Сессии после этого завершаются сами, их надо дождаться через WaitSessions
+func CloseSessions() int {
+	conns.mtx.Lock()
+	defer conns.mtx.Unlock()
+	for conn := range conns.list {
+		conn.Close()
+	}
+	return len(conns.list)
+}
+
+// WaitSessions - ждет завершения всех сессий не дольше timeout, вернет false если время вышло
+func WaitSessions(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&activeSessions) != 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// countReader - считает байты, принятые из соединения
+type countReader struct {
+	conn net.Conn
+}
+
+func (r countReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	metrics.BytesIn.Add(uint64(n))
+	return n, err
+}
+
+// StartNewSession - инициализирует все и стартует сессию. listener - имя слушателя, принявшего соединение (tcp, tls, ws)
+func StartNewSession(conn net.Conn, dT time.Duration, listener string) {
+	atomic.AddInt32(&activeSessions, 1)
+	defer atomic.AddInt32(&activeSessions, -1)
+	conns.add(conn)
+	defer conns.del(conn)
+	sessions := metrics.Sessions.With(listener)
+	sessions.Add(1)
+	defer sessions.Add(-1)
+	defer func(start time.Time) {
+		metrics.SessionDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+	reader := bufio.NewReader(countReader{conn})
 	conn.SetReadDeadline(time.Now().Add(dT))
-	if n, err := conn.Read(req); err == nil {
-		if p, err := parser.InitParser(req[:n], uint64(configuration.Config.MaxPacketSize)*1024); err == nil {
+	if _, err := reader.Peek(1); err == nil {
+		req, _ := reader.Peek(reader.Buffered()) // Первый кусок принятых данных, из буфера он не удаляется
+		if p, err := parser.InitParser(req, uint64(configuration.Get().MaxPacketSize)*1024); err == nil {
+			certNames := clientCertNames(conn) // TLS рукопожатие уже выполнено при первом чтении
+			if len(certNames) != 0 {
+				log.Infof("Client %s presented certificate for %v", conn.RemoteAddr(), certNames)
+			}
 			s := BidirectSession{
 				Duration: dT,
 				Tm:       time.NewTimer(dT),
-				netReq:   req,
-				logic:    CreatePanicCoverLogic(CreateReadWriteMainLogic(p, dT)),
+				reader:   reader,
+				logic:    CreatePanicCoverLogic(CreateReadWriteMainLogic(p, dT, conn.RemoteAddr().String(), certNames)),
 			}
 			s.Run(conn, p)
 			s.logic.Close()
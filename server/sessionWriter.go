@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	conf "github.com/blabu/egeonC2cService/configuration"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+	"github.com/blabu/egeonC2cService/metrics"
+)
+
+// writeBufferSize - размер буфера, в котором копятся сообщения, пока предыдущие записываются в соединение
+const writeBufferSize = 64 * 1024
+
+var errWriterClosed = errors.New("Session writer is closed")
+
+func durationMs(val uint32, def time.Duration) time.Duration {
+	if val == 0 {
+		return def
+	}
+	return time.Duration(val) * time.Millisecond
+}
+
+// writeTimeOut - время на запись size байт: WriteTimeOut и WriteTimeOutPerKb на каждый начатый килобайт
+func writeTimeOut(size int) time.Duration {
+	base := durationMs(conf.Get().WriteTimeOut, conf.DefaultWriteTimeOut*time.Millisecond)
+	perKb := durationMs(conf.Get().WriteTimeOutPerKb, conf.DefaultWriteTimeOutPerKb*time.Millisecond)
+	return base + time.Duration((size+1023)/1024)*perKb
+}
+
+func slowConsumerTime() time.Duration {
+	if conf.Get().SlowConsumerTime == 0 {
+		return conf.DefaultSlowConsumerTime * time.Second
+	}
+	return time.Duration(conf.Get().SlowConsumerTime) * time.Second
+}
+
+// sessionWriter - буферизированная запись в соединение.
+// Сообщения копятся в буфере, пока предыдущие записываются в соединение, и уходят одной записью.
+// Следит за временем записи и разрывает соединение, если клиент не успевает читать дольше SlowConsumerTime
+type sessionWriter struct {
+	conn    net.Conn
+	next    []byte        // Сообщения, ожидающие записи
+	out     []byte        // Сообщения, которые записываются сейчас
+	queued  int64         // Количество байт, принятых к отправке, но еще не записанных (атомарно)
+	latency time.Duration // Сглаженное время одной записи
+	behind  time.Time     // С какого момента клиент не успевает читать, нулевое если успевает
+	closed  bool
+	mtx     sync.Mutex
+	cond    *sync.Cond    // Сигнал об освобождении буфера
+	pending chan struct{} // Сигнал о новых данных в буфере
+	done    chan struct{} // Закрывается, когда запись завершена
+}
+
+func newSessionWriter(conn net.Conn) *sessionWriter {
+	w := &sessionWriter{
+		conn:    conn,
+		next:    make([]byte, 0, writeBufferSize),
+		out:     make([]byte, 0, writeBufferSize),
+		pending: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mtx)
+	return w
+}
+
+func (w *sessionWriter) signal() {
+	select {
+	case w.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Write - добавляет сообщение в буфер. Если буфер заполнен, ждет пока предыдущие сообщения будут записаны
+func (w *sessionWriter) Write(data []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for !w.closed && len(w.next) != 0 && len(w.next)+len(data) > writeBufferSize {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	w.next = append(w.next, data...)
+	atomic.AddInt64(&w.queued, int64(len(data)))
+	w.signal()
+	return len(data), nil
+}
+
+// Close - записывает оставшиеся сообщения и закрывает соединение
+func (w *sessionWriter) Close() error {
+	w.mtx.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mtx.Unlock()
+	w.signal()
+	<-w.done
+	return nil
+}
+
+func (w *sessionWriter) isClosed() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.closed
+}
+
+// run - записывает накопленные сообщения в соединение, пока не будет закрыт ctx, writer или не произойдет ошибка записи
+func (w *sessionWriter) run(ctx context.Context) {
+	defer close(w.done)
+	defer func() {
+		w.mtx.Lock()
+		w.closed = true
+		w.cond.Broadcast()
+		w.mtx.Unlock()
+	}()
+	for {
+		select {
+		case <-w.pending:
+			if err := w.flush(); err != nil {
+				log.Warningf("Close connection to %s: %v", w.conn.RemoteAddr(), err)
+				w.conn.Close()
+				return
+			}
+			if w.isClosed() {
+				w.conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flush - записывает в соединение все накопленные сообщения одной записью
+func (w *sessionWriter) flush() error {
+	w.mtx.Lock()
+	w.next, w.out = w.out[:0], w.next
+	w.cond.Broadcast()
+	w.mtx.Unlock()
+	if len(w.out) == 0 {
+		return nil
+	}
+	start := time.Now()
+	w.conn.SetWriteDeadline(start.Add(writeTimeOut(len(w.out))))
+	n, err := w.conn.Write(w.out)
+	metrics.BytesOut.Add(uint64(n))
+	queued := atomic.AddInt64(&w.queued, -int64(len(w.out)))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			metrics.SlowConsumers.Inc()
+			return fmt.Errorf("slow consumer, can not write %d bytes in %v, %d bytes queued", len(w.out), time.Since(start), queued)
+		}
+		return err
+	}
+	return w.account(time.Since(start), queued)
+}
+
+// account - учитывает время записи. Клиент начинает отставать, когда сглаженное время записи больше SlowConsumerLatency,
+// и перестает, когда записаны все принятые к отправке данные. Вернет ошибку, если клиент отстает дольше SlowConsumerTime
+func (w *sessionWriter) account(d time.Duration, queued int64) error {
+	w.latency += (d - w.latency) / 8
+	if queued == 0 { // Клиент успел прочитать все, что ему отправили
+		w.behind = time.Time{}
+		return nil
+	}
+	if w.behind.IsZero() {
+		if w.latency < durationMs(conf.Get().SlowConsumerLatency, conf.DefaultSlowConsumerLatency*time.Millisecond) {
+			return nil
+		}
+		w.behind = time.Now().Add(-d) // Клиент отстает с начала этой записи
+		log.Infof("Client %s is reading slowly, write latency %v, %d bytes queued", w.conn.RemoteAddr(), w.latency, queued)
+	}
+	if behind := time.Since(w.behind); behind > slowConsumerTime() {
+		metrics.SlowConsumers.Inc()
+		return fmt.Errorf("slow consumer, behind for %v, write latency %v, %d bytes queued", behind, w.latency, queued)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cf "github.com/blabu/egeonC2cService/configuration"
+	log "github.com/blabu/egeonC2cService/logWrapper"
+	"github.com/gorilla/websocket"
+)
+
+// wsListener - реализация net.Listener поверх WebSocket.
+// Каждое принятое WebSocket соединение превращается в поток байт (wsConn),
+// поэтому сессии, парсер и клиентская логика работают с ним так же как с TCP
+type wsListener struct {
+	srv      *http.Server
+	base     net.Listener
+	upgrader websocket.Upgrader
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewWebSocketListener - запускает http сервер на listen и принимает WebSocket соединения по пути path
+func NewWebSocketListener(listen net.Listener, path string) net.Listener {
+	if len(path) == 0 {
+		path = "/"
+	}
+	l := &wsListener{
+		base: listen,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: checkOrigin,
+		},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.upgrade)
+	l.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := l.srv.Serve(listen); err != nil && err != http.ErrServerClosed {
+			log.Errorf("WebSocket server finished with error %v", err)
+		}
+		l.Close()
+	}()
+	return l
+}
+
+// checkOrigin - разрешает подключения со страниц из WSAllowedOrigins, если список пуст - только со страниц этого же хоста.
+// Запросы без заголовка Origin отправляются не браузером и разрешены всегда
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	allowed := cf.Get().WSAllowedOrigins
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, val := range allowed {
+		if val == "*" || strings.EqualFold(strings.TrimSuffix(val, "/"), origin) {
+			return true
+		}
+	}
+	log.Infof("WebSocket connection from %s with origin %s is not allowed", r.RemoteAddr, origin)
+	return false
+}
+
+func (l *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warningf("Can not upgrade connection from %s to websocket %v", r.RemoteAddr, err)
+		return
+	}
+	select {
+	case l.conns <- &wsConn{ws: ws}:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+// Accept - ждет следующее WebSocket соединение
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("WebSocket listener is closed")
+	}
+}
+
+// Close - останавливает http сервер, уже принятые соединения продолжают работать
+func (l *wsListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.base.Addr()
+}
+
+// wsConn - net.Conn поверх WebSocket соединения.
+// Данные всех принятых сообщений читаются как непрерывный поток,
+// каждый вызов Write отправляется отдельным бинарным сообщением
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			t, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if t != websocket.BinaryMessage && t != websocket.TextMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}